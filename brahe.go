@@ -20,7 +20,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/term"
 )
 
 type GapOpts struct {
@@ -60,17 +64,63 @@ func (gov *gapOptsValue) Set(pattern string) error {
 	return nil
 }
 
+type stringListValue struct {
+	list *[]string
+}
+
+func (slv *stringListValue) String() string {
+	if slv.list == nil {
+		return ""
+	}
+	return strings.Join(*slv.list, ";")
+}
+
+func (slv *stringListValue) Set(value string) error {
+	*slv.list = append(*slv.list, value)
+	return nil
+}
+
 type Config struct {
 	depth              int
+	jobs               int
+	reads              []string
+	readsDefault       int
+	readsPerDevice     map[string]int
 	entries            []string
 	noData             bool
+	quick              bool
+	metaList           string
+	meta               map[string]bool
+	mtimeWindow        time.Duration
+	hash               string
+	cache              string
+	rehash             bool
+	strict             bool
+	followSymlinks     bool
+	skipSpecial        bool
+	hardlinks          bool
+	sparse             bool
+	majority           bool
+	repair             bool
+	failFast           bool
+	report             string
+	yes                bool
 	checkSysNames      bool
 	ignoreSpecificDirs map[string]bool
 	ignoreFiles        map[string]bool
+	includes           []*Pattern
+	excludes           []*Pattern
 	gapOpts            *GapOpts
 	buildDB            bool
 	checkDB            bool
 	deleteDupes        bool
+	findDupes          bool
+	dryRun             bool
+	quarantine         string
+	keep               string
+	link               string
+	prefer             []string
+	dupesIn            []string
 	copy               string
 }
 
@@ -90,12 +140,101 @@ func getConfig(arguments []string) (*Config, error) {
 		-1,
 		"Specify how deep into the directory hierarchy to look into.\nUse 0 to check only immediate files/directories with no traversing.\nUse -1 for no limit.",
 	)
+	f.IntVar(
+		&cfg.jobs,
+		"jobs",
+		1,
+		"How many directories to walk and files to hash at the same time.",
+	)
+	f.Var(
+		&stringListValue{&cfg.reads},
+		"reads",
+		"Limit how many files are read at the same time from a single device, e.g. 1 for spinning disks.\nThe `limit` is either N for all devices or path=N for the device of path. Can be specified multiple times.",
+	)
+	f.StringVar(
+		&cfg.hash,
+		"hash",
+		defaultHashAlgorithm,
+		"The hash `algorithm` used to compare file contents, one of: "+strings.Join(getHashAlgorithmNames(), ", ")+".\nThe crc32c algorithm is fast but only good for quick checks and can't be used with -delete-dupes.",
+	)
+	f.StringVar(
+		&cfg.cache,
+		"cache",
+		"",
+		"Remember file hashes in the provided `file` (e.g. ~/.cache/brahe) and reuse them for files that haven't changed.\nOnly the hashes of the files seen in the latest run are kept.",
+	)
+	f.BoolVar(
+		&cfg.rehash,
+		"rehash",
+		false,
+		"Read all the files even if their hashes are in the -cache, e.g. to detect bit rot.",
+	)
 	f.BoolVar(
 		&cfg.noData,
 		"no-data",
 		false,
 		"Don't compare the file contents.",
 	)
+	f.BoolVar(
+		&cfg.quick,
+		"quick",
+		false,
+		"Only compare file sizes instead of the contents.",
+	)
+	f.DurationVar(
+		&cfg.mtimeWindow,
+		"mtime-window",
+		0,
+		"Report files whose modification times differ by more than `duration` (e.g. 2s for FAT).",
+	)
+	f.StringVar(
+		&cfg.metaList,
+		"meta",
+		"",
+		"Also compare the metadata in the comma separated `list` of: "+strings.Join(metaAttributes, ", ")+".\nThe xattr attribute covers all extended attributes besides ACLs and SELinux labels.",
+	)
+	f.BoolVar(
+		&cfg.strict,
+		"strict",
+		false,
+		"Also report any files/directories in [target1] .. [targetN] that don't exist in [source].",
+	)
+	f.BoolVar(
+		&cfg.followSymlinks,
+		"follow-symlinks",
+		false,
+		"Compare what symlinks point to, instead of comparing where they point to.",
+	)
+	f.BoolVar(
+		&cfg.hardlinks,
+		"hardlinks",
+		false,
+		"Also verify that files hardlinked together in [source] are hardlinked the same way in the targets.",
+	)
+	f.BoolVar(
+		&cfg.sparse,
+		"sparse",
+		false,
+		"Also report files in the targets that take up far more disk space than in [source], because they lost their sparseness.",
+	)
+	f.BoolVar(
+		&cfg.skipSpecial,
+		"skip-special",
+		false,
+		"Ignore FIFOs, sockets and device nodes.",
+	)
+	f.BoolVar(
+		&cfg.majority,
+		"majority",
+		false,
+		"Let the copies vote on the correct file contents and report the ones that differ from the majority.\nMore than half of the copies have to agree. Requires at least two targets.",
+	)
+	f.BoolVar(
+		&cfg.repair,
+		"repair",
+		false,
+		"Overwrite any copies with wrong contents with a good copy.\nThe good copy is [source] or with -majority the one the majority agrees on.",
+	)
 	f.BoolVar(
 		&cfg.checkSysNames,
 		"system-names",
@@ -118,7 +257,75 @@ func getConfig(arguments []string) (*Config, error) {
 		&cfg.deleteDupes,
 		"delete-dupes",
 		false,
-		"Deletes any duplicate files in [source].",
+		"Deletes any duplicate files in [source] .. [targetN].",
+	)
+	f.BoolVar(
+		&cfg.failFast,
+		"fail-fast",
+		false,
+		"Stop at the first error instead of reporting it and continuing.",
+	)
+	f.BoolVar(
+		&cfg.yes,
+		"yes",
+		false,
+		"Start without asking for confirmation.\nThis is assumed when not running in a terminal, except for -delete-dupes without -dry-run and -repair.",
+	)
+	f.StringVar(
+		&cfg.report,
+		"report",
+		"",
+		"Write every result as a JSON object per line into the provided `file`.",
+	)
+	f.BoolVar(
+		&cfg.findDupes,
+		"find-dupes",
+		false,
+		"Lists any duplicate files in [source] .. [targetN] without modifying anything.",
+	)
+	f.BoolVar(
+		&cfg.dryRun,
+		"dry-run",
+		false,
+		"Only list the duplicates that -delete-dupes would get rid of.",
+	)
+	f.StringVar(
+		&cfg.quarantine,
+		"quarantine",
+		"",
+		"Duplicates found with -delete-dupes are moved into the provided `directory` instead of being deleted.",
+	)
+	f.StringVar(
+		&cfg.keep,
+		"keep",
+		KeepFirst,
+		"Which one of the duplicates found with -delete-dupes to keep.\nThe `policy` is one of: "+strings.Join(keepPolicies, ", ")+".",
+	)
+	f.StringVar(
+		&cfg.link,
+		"link",
+		"",
+		"Replace duplicates found with -delete-dupes with links to the kept file instead of deleting them.\nThe `type` is either "+LinkHard+" or "+LinkReflink+", where reflinks are copy-on-write clones that need filesystem support.",
+	)
+	f.Var(
+		&patternListValue{&cfg.includes},
+		"include",
+		"Only compare the files that match the glob `pattern`, relative to [source] .. [targetN].\nCan be specified multiple times. Patterns without a slash match names at any depth,\nothers are anchored to the top. A trailing slash only matches directories and ** matches any number of directories.",
+	)
+	f.Var(
+		&patternListValue{&cfg.excludes},
+		"exclude",
+		"Skip the files and directories that match the glob `pattern`, e.g. node_modules, .git/ or **/*.tmp.\nCan be specified multiple times. The patterns work the same way as with -include.",
+	)
+	f.Var(
+		&stringListValue{&cfg.prefer},
+		"prefer",
+		"Keep the duplicates in the provided `directory` over any others, regardless of -keep.\nCan be specified multiple times, with the earlier directories preferred.",
+	)
+	f.Var(
+		&stringListValue{&cfg.dupesIn},
+		"dupes-in",
+		"Only deal with the duplicates in the provided `directory`, any others are just for reference.\nCan be specified multiple times. By default duplicates anywhere in [source] .. [targetN] are dealt with.",
 	)
 	f.StringVar(
 		&cfg.copy,
@@ -141,8 +348,117 @@ func getConfig(arguments []string) (*Config, error) {
 	if cfg.noData && (cfg.buildDB || cfg.checkDB) {
 		return nil, failf("Can't deal with the hash database without looking at file contents! Check your options.")
 	}
+	if cfg.quick && (cfg.noData || cfg.majority || cfg.repair || cfg.buildDB || cfg.checkDB || cfg.deleteDupes || cfg.findDupes) {
+		return nil, failf("The -quick mode only works for a plain comparison! Check your options.")
+	}
+	cfg.meta = map[string]bool{}
+	if cfg.metaList != "" {
+		for _, attribute := range strings.Split(cfg.metaList, ",") {
+			known := false
+			for _, a := range metaAttributes {
+				known = known || a == attribute
+			}
+			if !known {
+				return nil, failf("Unknown metadata attribute %q, expected one of: %v", attribute, strings.Join(metaAttributes, ", "))
+			}
+			cfg.meta[attribute] = true
+		}
+	}
+	f.Visit(func(fl *flag.Flag) {
+		if fl.Name == "mtime-window" {
+			cfg.meta[MetaMtime] = true
+		}
+	})
+	if len(cfg.meta) > 0 && (cfg.gapOpts != nil || cfg.buildDB || cfg.checkDB || cfg.deleteDupes || cfg.findDupes) {
+		return nil, failf("Metadata can only be compared between directories! Check your options.")
+	}
+	if cfg.sparse && (cfg.gapOpts != nil || cfg.buildDB || cfg.checkDB || cfg.deleteDupes || cfg.findDupes) {
+		return nil, failf("Sparseness can only be compared between directories! Check your options.")
+	}
+	if cfg.hardlinks && (cfg.gapOpts != nil || cfg.buildDB || cfg.checkDB || cfg.deleteDupes || cfg.findDupes) {
+		return nil, failf("Hardlinks can only be verified when comparing directories! Check your options.")
+	}
+	if cfg.followSymlinks && (cfg.gapOpts != nil || cfg.buildDB || cfg.checkDB || cfg.deleteDupes || cfg.findDupes) {
+		return nil, failf("Symlinks can only be followed when comparing directories! Check your options.")
+	}
+	if cfg.meta[MetaOwner] && !ownerSupported {
+		return nil, failf("File ownership can't be compared on this platform.")
+	}
+	if (cfg.meta[MetaXattr] || cfg.meta[MetaACL] || cfg.meta[MetaSELinux]) && !xattrSupported {
+		return nil, failf("Extended attributes can't be compared on this platform.")
+	}
+	if cfg.mtimeWindow < 0 {
+		return nil, failf("The -mtime-window can't be negative.")
+	}
+	if cfg.majority && cfg.noData {
+		return nil, failf("Can't vote on file contents without looking at them! Check your options.")
+	}
+	if cfg.repair && cfg.noData {
+		return nil, failf("Can't repair file contents without looking at them! Check your options.")
+	}
+	if cfg.findDupes && cfg.deleteDupes {
+		return nil, failf("Can't both find and delete duplicates! Use -delete-dupes with -dry-run to see what would be deleted.")
+	}
+	if (cfg.dryRun || cfg.quarantine != "" || cfg.link != "") && !cfg.deleteDupes {
+		return nil, failf("The -dry-run, -quarantine and -link options only work with -delete-dupes.")
+	}
+	if (len(cfg.prefer) > 0 || len(cfg.dupesIn) > 0) && !cfg.deleteDupes && !cfg.findDupes {
+		return nil, failf("The -prefer and -dupes-in options only work with -delete-dupes or -find-dupes.")
+	}
+	if cfg.link != "" && cfg.link != LinkHard && cfg.link != LinkReflink {
+		return nil, failf("Unknown link type %v, expected %v or %v", cfg.link, LinkHard, LinkReflink)
+	}
+	if cfg.link != "" && cfg.quarantine != "" {
+		return nil, failf("Duplicates can't be both linked and quarantined! Check your options.")
+	}
+	validKeep := false
+	for _, policy := range keepPolicies {
+		validKeep = validKeep || cfg.keep == policy
+	}
+	if !validKeep {
+		return nil, failf("Unknown keep policy %v, expected one of: %v", cfg.keep, strings.Join(keepPolicies, ", "))
+	}
+	if _, ok := hashAlgorithms[cfg.hash]; !ok {
+		return nil, failf("Unknown hash algorithm %v, expected one of: %v", cfg.hash, strings.Join(getHashAlgorithmNames(), ", "))
+	}
+	if cfg.deleteDupes && weakHashAlgorithms[cfg.hash] {
+		return nil, failf("The %v hash algorithm is too weak to decide which files can be deleted! Check your options.", cfg.hash)
+	}
+	if cfg.rehash && cfg.cache == "" {
+		return nil, failf("There's nothing to rehash without a -cache! Check your options.")
+	}
+	if cfg.jobs < 1 {
+		return nil, failf("Need at least one job, got %d.", cfg.jobs)
+	}
+	cfg.readsPerDevice = map[string]int{}
+	for _, reads := range cfg.reads {
+		path, limitStr := "", reads
+		if idx := strings.LastIndex(reads, "="); idx != -1 {
+			path, limitStr = reads[:idx], reads[idx+1:]
+		}
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			return nil, failf("Invalid read limit %v", reads)
+		}
+		if path == "" {
+			cfg.readsDefault = limit
+			continue
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, failf("Invalid path? %v - %v", path, err)
+		}
+		device, err := deviceOf(absPath, nil)
+		if err != nil {
+			return nil, failf("Failed to find the device of %v - %v", path, err)
+		}
+		cfg.readsPerDevice[device] = limit
+	}
 	minArgs := 2
-	if cfg.gapOpts != nil || cfg.deleteDupes {
+	if cfg.majority {
+		minArgs = 3
+	}
+	if cfg.gapOpts != nil || cfg.deleteDupes || cfg.findDupes {
 		minArgs = 1
 	}
 	args := f.Args()
@@ -156,6 +472,32 @@ func getConfig(arguments []string) (*Config, error) {
 		}
 		cfg.entries = append(cfg.entries, entry)
 	}
+	for _, dirs := range [][]string{cfg.prefer, cfg.dupesIn} {
+		for i := range dirs {
+			dir, err := filepath.Abs(dirs[i])
+			if err != nil {
+				return nil, failf("Invalid path? %v - %v", dirs[i], err)
+			}
+			dirs[i] = dir
+		}
+	}
+	if cfg.deleteDupes || cfg.findDupes {
+		// Any overlap would make files look like duplicates of themselves
+		for i := range cfg.entries {
+			for j := range cfg.entries {
+				if i != j && containingDir(cfg.entries[i:i+1], cfg.entries[j]) == 0 {
+					return nil, failf("Can't look for duplicates in %v as it's also inside %v", cfg.entries[j], cfg.entries[i])
+				}
+			}
+		}
+	}
+	if cfg.quarantine != "" {
+		quarantine, err := filepath.Abs(cfg.quarantine)
+		if err != nil {
+			return nil, failf("Invalid path? %v - %v", cfg.quarantine, err)
+		}
+		cfg.quarantine = quarantine
+	}
 	if !cfg.checkSysNames {
 		cfg.ignoreSpecificDirs = map[string]bool{}
 		for _, entry := range cfg.entries {
@@ -167,9 +509,46 @@ func getConfig(arguments []string) (*Config, error) {
 		cfg.ignoreFiles = map[string]bool{}
 		cfg.ignoreFiles["Thumbs.db"] = true
 	}
+	if cfg.quarantine != "" {
+		// Don't go looking for duplicates among the ones we already moved
+		if cfg.ignoreSpecificDirs == nil {
+			cfg.ignoreSpecificDirs = map[string]bool{}
+		}
+		cfg.ignoreSpecificDirs[cfg.quarantine] = true
+	}
 	return cfg, nil
 }
 
+// Process exit codes
+const (
+	ExitOK          = 0 // Everything matched
+	ExitDifferences = 1 // Found mismatched, missing or extra entries
+	ExitUsage       = 2 // Invalid command line arguments
+	ExitErrors      = 3 // Failed to deal with some paths, so the results are incomplete
+)
+
+// Decides the exit code based on the final stats
+func getExitCode(cfg *Config) int {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if stats.errors > 0 {
+		return ExitErrors
+	}
+	if cfg.deleteDupes || cfg.findDupes || cfg.buildDB {
+		// The counts don't indicate anything wrong in these modes
+		return ExitOK
+	}
+	if stats.mismatched > 0 || stats.missing > 0 || stats.extra > 0 || stats.copied > 0 {
+		return ExitDifferences
+	}
+	return ExitOK
+}
+
+// Returns true if the work modifies the compared directories
+func (cfg *Config) isDestructive() bool {
+	return (cfg.deleteDupes && !cfg.dryRun) || cfg.repair
+}
+
 // NOTE: Also returns false in case of EOF (e.g. Ctrl+C)
 func askBool(question string) bool {
 	fmt.Printf("%v (Y/N) - ", question)
@@ -192,8 +571,10 @@ func askBool(question string) bool {
 func main() {
 	// Parse the command line arguments
 	cfg, err := getConfig(os.Args[1:])
-	if err != nil {
-		os.Exit(2)
+	if err == flag.ErrHelp {
+		os.Exit(ExitOK)
+	} else if err != nil {
+		os.Exit(ExitUsage)
 	}
 
 	for i := range cfg.entries {
@@ -203,37 +584,94 @@ func main() {
 		}
 		fmt.Printf("%v: %v\n", header, cfg.entries[i])
 	}
-	if !askBool("Start comparing?") {
-		return
+	if !cfg.yes {
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			if !askBool("Start comparing?") {
+				return
+			}
+		} else if cfg.isDestructive() {
+			fmt.Println("Refusing to modify files without confirmation! Use -yes when not running in a terminal.")
+			os.Exit(ExitUsage)
+		}
+	}
+	if cfg.report != "" {
+		if err := report.Open(cfg.report); err != nil {
+			fmt.Printf("Failed to create the report: %v\n", err)
+			os.Exit(ExitErrors)
+		}
 	}
 
 	// NOTE: From here on out, we no longer directly use fmt.Printf
+	errorLog.failFast = cfg.failFast
+	hashAlgorithm = cfg.hash
+	if cfg.hardlinks {
+		hardlinks.Enable()
+	}
 	writeToConsole("Starting work ..")
+	if cfg.cache != "" {
+		if err := hashCache.Load(cfg.cache, cfg.rehash); err != nil {
+			reportError(cfg.cache, fmt.Errorf("Failed to load the hash cache: %v", err))
+		}
+	}
 	displayInfo.Show()
 	shutdown.AddWorkers(1)
 	go statsGalore()
+	workPool.Start(cfg.jobs)
+	ioScheduler.Configure(cfg.readsDefault, cfg.readsPerDevice)
+	outputQueue.Start()
 
 	if cfg.gapOpts != nil {
-		findGaps(cfg, 100.0, cfg.entries)
+		findGaps(cfg, 100.0, entryReplicas(cfg.entries))
 	} else if cfg.deleteDupes {
-		deleteDupes(cfg, 100.0, cfg.entries[0], cfg.depth, map[[32]byte]struct{}{})
+		deleteDupes(cfg, 100.0)
+	} else if cfg.findDupes {
+		findDupes(cfg, 100.0)
 	} else if cfg.buildDB {
-		initDB(cfg.entries[1])
-		useDB(cfg, 100.0, cfg.entries[0], cfg.depth)
+		if err := initDB(cfg.entries[1], cfg.hash); err != nil {
+			reportError(cfg.entries[1], err)
+		} else {
+			out := outputQueue.Push()
+			useDB(cfg, out, 100.0, 0, cfg.entries[0], cfg.depth)
+			out.Done()
+		}
 	} else if cfg.checkDB {
-		verifyDB(cfg.entries[0])
-		progressChunk, progressExtra := splitProgressValue(100.0, len(cfg.entries)-1)
-		for i := 1; i < len(cfg.entries); i++ {
-			useDB(cfg, progressChunk, cfg.entries[i], cfg.depth)
-		}
-		stats.lock.Lock()
-		stats.progress += progressExtra
-		stats.lock.Unlock()
+		if err := verifyDB(cfg.entries[0], cfg.hash); err != nil {
+			reportError(cfg.entries[0], err)
+		} else {
+			progressChunk, progressExtra := splitProgressValue(100.0, len(cfg.entries)-1)
+			for i := 1; i < len(cfg.entries); i++ {
+				out := outputQueue.Push()
+				useDB(cfg, out, progressChunk, i, cfg.entries[i], cfg.depth)
+				out.Done()
+			}
+			stats.lock.Lock()
+			stats.progress += progressExtra
+			stats.lock.Unlock()
+		}
 	} else {
-		compareDir(cfg, 100.0, cfg.entries, cfg.depth)
+		out := outputQueue.Push()
+		compareDir(cfg, out, 100.0, entryReplicas(cfg.entries), cfg.depth, nil)
+		out.Done()
+	}
+
+	workPool.Stop()
+	outputQueue.Stop()
+	if errorLog.Stopped() {
+		writeToConsole("Stopped at the first error because of -fail-fast.")
+	}
+
+	if err := hashCache.Save(); err != nil {
+		reportError(cfg.cache, fmt.Errorf("Failed to save the hash cache: %v", err))
 	}
 
 	displayInfo.Hide()
 	shutdown.Start()
 	shutdown.Wait()
+
+	exitCode := getExitCode(cfg)
+	if err := report.Close(); err != nil {
+		fmt.Printf("Failed to write the report: %v\n", err)
+		exitCode = ExitErrors
+	}
+	os.Exit(exitCode)
 }
@@ -0,0 +1,145 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileID identifies a specific version of a file.
+// Any change to the file contents also changes at least the change time.
+type FileID struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime int64
+	ctime int64
+}
+
+type cacheKey struct {
+	algorithm string
+	id        FileID
+}
+
+// HashCache remembers file hashes between runs, so unchanged files don't need to be read again.
+// Only the hashes of the files seen during the run are saved, so the cache doesn't grow forever.
+type HashCache struct {
+	lock    sync.Mutex
+	path    string
+	rehash  bool                // Always read the files, but still update the cache
+	entries map[cacheKey][]byte // Loaded from the file
+	seen    map[cacheKey][]byte // Used during this run
+	dirty   bool
+}
+
+// Loads the cache from the file at path, which doesn't need to exist yet
+func (hc *HashCache) Load(path string, rehash bool) error {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	hc.path = path
+	hc.rehash = rehash
+	hc.entries = map[cacheKey][]byte{}
+	hc.seen = map[cacheKey][]byte{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var key cacheKey
+		var hash []byte
+		_, err := fmt.Sscanf(scanner.Text(), "%s %d %d %d %d %d %x",
+			&key.algorithm, &key.id.dev, &key.id.ino, &key.id.size, &key.id.mtime, &key.id.ctime, &hash)
+		if err != nil {
+			continue // Skip the corrupt entry, it won't be saved again
+		}
+		hc.entries[key] = hash
+	}
+	return scanner.Err()
+}
+
+func (hc *HashCache) Get(id FileID) ([]byte, bool) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	if hc.entries == nil || hc.rehash {
+		return nil, false
+	}
+	key := cacheKey{algorithm: hashAlgorithm, id: id}
+	hash, ok := hc.entries[key]
+	if ok {
+		hc.seen[key] = hash
+	}
+	return hash, ok
+}
+
+func (hc *HashCache) Put(id FileID, hash []byte) {
+	hc.lock.Lock()
+	if hc.entries != nil {
+		key := cacheKey{algorithm: hashAlgorithm, id: id}
+		hc.entries[key] = hash
+		hc.seen[key] = hash
+		hc.dirty = true
+	}
+	hc.lock.Unlock()
+}
+
+// Atomically writes the hashes seen during this run back to the file, if anything changed
+func (hc *HashCache) Save() error {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	if !hc.dirty && len(hc.seen) == len(hc.entries) {
+		return nil // Nothing new and nothing to prune
+	}
+
+	if err := os.MkdirAll(filepath.Dir(hc.path), 0777); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(hc.path), "."+filepath.Base(hc.path)+".brahe-")
+	if err != nil {
+		return err
+	}
+	tmpName := out.Name()
+	defer os.Remove(tmpName) // Only matters when we fail before the rename
+	defer out.Close()        // Defer it to be sure it's closed, although we'll manually close it in a good scenario
+
+	w := bufio.NewWriter(out)
+	for key, hash := range hc.seen {
+		fmt.Fprintf(w, "%s %d %d %d %d %d %x\n",
+			key.algorithm, key.id.dev, key.id.ino, key.id.size, key.id.mtime, key.id.ctime, hash)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, hc.path); err != nil {
+		return err
+	}
+	hc.dirty = false
+	return nil
+}
+
+var hashCache = HashCache{}
@@ -24,8 +24,6 @@ import (
 	"sync"
 )
 
-// TODO: Add back strict non-haystack check (for excessive files in target directories that don't exist in source)
-
 // TODO: On Windows detect MAX_PATH violations -- even though we could bypass them with UNC, it's explorer nightmare
 
 func splitProgressValue(value float64, parts int) (chunk float64, extra float64) {
@@ -36,29 +34,63 @@ func splitProgressValue(value float64, parts int) (chunk float64, extra float64)
 	return
 }
 
-func getFileList(dirName string) []os.FileInfo {
-	files, err := ioutil.ReadDir(dirName)
-	if err != nil {
-		writeToConsole("ReadDir failed: %v", err)
-		panic("")
+func getFileList(dirName string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirName)
+}
+
+// Replica is a single copy of an entry in one of the compared directories
+type Replica struct {
+	idx  int // Index in Config.entries, 0 being the source
+	path string
+	info os.FileInfo // Not known for the entries themselves
+}
+
+func entryReplicas(entries []string) []Replica {
+	replicas := make([]Replica, len(entries))
+	for i := range entries {
+		replicas[i] = Replica{idx: i, path: entries[i]}
 	}
-	return files
+	return replicas
 }
 
-func getFileLists(dirNames []string) [][]os.FileInfo {
-	// Get the file list for this directory
-	allFileInfos := make([][]os.FileInfo, len(dirNames))
-	for idx, dirName := range dirNames {
-		allFileInfos[idx] = getFileList(dirName)
+// Returns the directories that could be read along with their file lists.
+// Any directories that fail to be read are reported and left out.
+func getFileLists(out *Output, dirs []Replica) ([]Replica, [][]os.FileInfo) {
+	// Get the file lists for this directory in parallel, as the copies are usually on different disks
+	fileLists := make([][]os.FileInfo, len(dirs))
+	errs := make([]error, len(dirs))
+
+	var wg sync.WaitGroup
+	wg.Add(len(dirs))
+	for idx, dir := range dirs {
+		go func(idx int, name string) {
+			fileLists[idx], errs[idx] = getFileList(name)
+			wg.Done()
+		}(idx, dir.path)
 	}
-	return allFileInfos
+	wg.Wait()
+
+	readDirs := make([]Replica, 0, len(dirs))
+	allFileInfos := make([][]os.FileInfo, 0, len(dirs))
+	for idx, dir := range dirs {
+		if errs[idx] != nil {
+			out.Error(dir.path, errs[idx])
+			continue
+		}
+		readDirs = append(readDirs, dir)
+		allFileInfos = append(allFileInfos, fileLists[idx])
+	}
+	return readDirs, allFileInfos
 }
 
-func findGaps(cfg *Config, progressValue float64, dirNames []string) {
+func findGaps(cfg *Config, progressValue float64, dirs []Replica) {
 	gapFormat := cfg.gapOpts.GetFormat()
 
 	// Get the file list for this directory
-	allFileInfos := getFileLists(dirNames)
+	out := newOutput()
+	dirs, allFileInfos := getFileLists(out, dirs)
+	out.Done()
+	out.flush()
 
 	fiCount := 0
 	for i := range allFileInfos {
@@ -68,7 +100,7 @@ func findGaps(cfg *Config, progressValue float64, dirNames []string) {
 	progressChunk, progressExtra := splitProgressValue(progressValue, fiCount)
 
 	stats.lock.Lock()
-	stats.missing = len(dirNames) * (cfg.gapOpts.end - cfg.gapOpts.begin + 1)
+	stats.missing = len(dirs) * (cfg.gapOpts.end - cfg.gapOpts.begin + 1)
 	stats.lock.Unlock()
 
 	for i := range allFileInfos {
@@ -79,9 +111,17 @@ func findGaps(cfg *Config, progressValue float64, dirNames []string) {
 
 		for j := range allFileInfos[i] {
 			name := allFileInfos[i][j].Name()
-			fullName := filepath.Join(dirNames[i], name)
+			fullName := filepath.Join(dirs[i].path, name)
 			isDir := allFileInfos[i][j].IsDir()
 
+			if cfg.isIgnored(dirs[i].idx, fullName, allFileInfos[i][j]) {
+				stats.lock.Lock()
+				stats.progress += progressChunk
+				stats.ignored++
+				stats.lock.Unlock()
+				continue
+			}
+
 			if !isDir {
 				if _, ok := foundFiles[name]; ok {
 					foundFiles[name] = true
@@ -101,7 +141,7 @@ func findGaps(cfg *Config, progressValue float64, dirNames []string) {
 		for seq := cfg.gapOpts.begin; seq <= cfg.gapOpts.end; seq++ {
 			name := fmt.Sprintf(gapFormat, seq)
 			if !foundFiles[name] {
-				writeToConsole("MISSING %s", name)
+				reportMismatch(newEvent("MISSING", nil, &Replica{idx: dirs[i].idx, path: filepath.Join(dirs[i].path, name)}))
 			}
 		}
 	}
@@ -113,90 +153,184 @@ func findGaps(cfg *Config, progressValue float64, dirNames []string) {
 }
 
 const dbDirectory = "BraheDB"
+const dbAlgorithmFile = "algorithm"
+
+// Returns the hash algorithm that the database was built with
+func getDBAlgorithm(dbDir string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dbDir, dbAlgorithmFile))
+	if os.IsNotExist(err) {
+		return defaultHashAlgorithm, nil // Databases from before the algorithm was recorded
+	} else if err != nil {
+		return "", fmt.Errorf("Failed to read the database hash algorithm: %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
 
-func initDB(parentDir string) {
+func checkDBAlgorithm(dbDir string, algorithm string) error {
+	dbAlgorithm, err := getDBAlgorithm(dbDir)
+	if err != nil {
+		return err
+	}
+	if dbAlgorithm != algorithm {
+		return fmt.Errorf("The database was built with %v, but %v was requested! Use -hash %v", dbAlgorithm, algorithm, dbAlgorithm)
+	}
+	return nil
+}
+
+func initDB(parentDir string, algorithm string) error {
 	dbDir := filepath.Join(parentDir, dbDirectory)
-	if err := os.Mkdir(dbDir, 0666); err != nil && !os.IsExist(err) {
-		writeToConsole("Failed to create directory %v: %v", dbDir, err)
-		panic("")
+	if err := os.Mkdir(dbDir, 0666); os.IsExist(err) {
+		return checkDBAlgorithm(dbDir, algorithm)
+	} else if err != nil {
+		return fmt.Errorf("Failed to create directory %v: %v", dbDir, err)
+	}
+	algorithmFile := filepath.Join(dbDir, dbAlgorithmFile)
+	if err := ioutil.WriteFile(algorithmFile, []byte(algorithm+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write file %v: %v", algorithmFile, err)
 	}
+	return nil
 }
 
-func verifyDB(parentDir string) {
+func verifyDB(parentDir string, algorithm string) error {
 	dbDir := filepath.Join(parentDir, dbDirectory)
 	if fi, err := os.Stat(dbDir); err != nil {
 		if os.IsNotExist(err) {
-			writeToConsole("You need to build a database! No database exists in %v", parentDir)
-			panic("")
-		} else {
-			writeToConsole("Failed to check database existance: %v", err)
-			panic("")
+			return fmt.Errorf("You need to build a database! No database exists in %v", parentDir)
 		}
+		return fmt.Errorf("Failed to check database existance: %v", err)
 	} else if !fi.IsDir() {
-		writeToConsole("The database needs to be inside a directory! %v is not a directory.", dbDir)
-		panic("")
+		return fmt.Errorf("The database needs to be inside a directory! %v is not a directory.", dbDir)
 	}
+	return checkDBAlgorithm(dbDir, algorithm)
 }
 
 // Returns true if any data was modified
-func ensureDBEntry(parentDir string, hash []byte, entry string) bool {
+func ensureDBEntry(parentDir string, hash []byte, entry string) (bool, error) {
 	hashHex := fmt.Sprintf("%x", hash)
 	hashFileDir := filepath.Join(parentDir, dbDirectory, hashHex[:2])
 	if err := os.Mkdir(hashFileDir, 0666); err != nil && !os.IsExist(err) {
-		writeToConsole("Failed to create directory %v: %v", hashFileDir, err)
-		panic("")
+		return false, fmt.Errorf("Failed to create directory %v: %v", hashFileDir, err)
 	}
 	hashFile := filepath.Join(hashFileDir, hashHex[2:])
 	f, err := os.OpenFile(hashFile, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
-		writeToConsole("Failed to open file %v: %v", hashFile, err)
-		panic("")
+		return false, fmt.Errorf("Failed to open file %v: %v", hashFile, err)
 	}
 	defer f.Close()
 	b, err := ioutil.ReadAll(f)
 	if err != nil {
-		writeToConsole("Failed to read file %v: %v", hashFile, err)
-		panic("")
+		return false, fmt.Errorf("Failed to read file %v: %v", hashFile, err)
 	}
 	lines := strings.Split(string(b), "\n")
 	for _, line := range lines {
 		if line == entry {
-			return false
+			return false, nil
 		}
 	}
 	if _, err := f.WriteString(entry + "\n"); err != nil {
-		writeToConsole("Failed to add entry to file %v: %v", hashFile, err)
-		panic("")
+		return false, fmt.Errorf("Failed to add entry to file %v: %v", hashFile, err)
 	}
-	return true
+	return true, nil
 }
 
-func hasDBEntry(parentDir string, hash []byte) bool {
+func hasDBEntry(parentDir string, hash []byte) (bool, error) {
 	hashHex := fmt.Sprintf("%x", hash)
 	hashFile := filepath.Join(parentDir, dbDirectory, hashHex[:2], hashHex[2:])
 	_, err := os.Stat(hashFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return false
+			return false, nil
 		}
-		writeToConsole("Failed to get file info %v: %v", hashFile, err)
-		panic("")
+		return false, fmt.Errorf("Failed to get file info %v: %v", hashFile, err)
 	}
-	return true
+	return true, nil
+}
+
+// Builds or checks the hash database entry of a single file.
+// Returns the changes to the matched, missing and copied counts.
+func useDBFile(cfg *Config, out *Output, replica *Replica) (deltaMatched, deltaMissing, deltaCopied int) {
+	fullName := replica.path
+	hash, _, err := hashReplica(replica)
+	if err != nil {
+		out.Error(fullName, err)
+		return
+	}
+	//writeToConsole("OK %.4f MB/s %x %v", speed, hash, fullName)
+
+	ev := newEvent("", nil, replica)
+	ev.TargetHash = fmt.Sprintf("%x", hash)
+
+	if cfg.buildDB {
+		// Write out the DB entry
+		if modified, err := ensureDBEntry(cfg.entries[1], hash, fullName); err != nil {
+			out.Error(fullName, err)
+		} else if modified {
+			deltaCopied++
+		} else {
+			deltaMatched++
+		}
+	} else if cfg.checkDB {
+		// Check if the DB entry exists
+		if exists, err := hasDBEntry(cfg.entries[0], hash); err != nil {
+			out.Error(fullName, err)
+		} else if !exists {
+			// Copy it if requested
+			if len(cfg.copy) > 0 {
+				// TODO: Rewrite the function to keep track of either the base entry or something like that,
+				//       instead of this scanning to figure it out.
+				suffix := ""
+				for _, entry := range cfg.entries {
+					if strings.HasPrefix(fullName, entry) {
+						suffix = fullName[len(entry):]
+						break
+					}
+				}
+				if suffix == "" {
+					panic("Didn't find entry prefix!")
+				}
+				dst := filepath.Join(cfg.copy, suffix)
+				if err := os.MkdirAll(filepath.Dir(dst), 0666); err != nil {
+					out.Error(fullName, fmt.Errorf("Failed to create directory %v because: %v", filepath.Dir(dst), err))
+				} else if err := copyFile(fullName, dst); err != nil {
+					out.Error(fullName, fmt.Errorf("Failed to copy to %v because: %v", dst, err))
+				} else {
+					ev.Type = "COPIED"
+					out.Mismatch(ev)
+					deltaCopied++
+				}
+			} else {
+				ev.Type = "MISSING"
+				out.Mismatch(ev)
+				deltaMissing++
+			}
+		} else {
+			ev.Type = "MATCH"
+			out.Match(ev)
+			deltaMatched++
+		}
+	}
+	return
 }
 
-func useDB(cfg *Config, progressValue float64, dirName string, depth int) {
-	fileInfos := getFileList(dirName)
+// The results are nested into parent, which the caller has to mark as done
+func useDB(cfg *Config, parent *Output, progressValue float64, entryIdx int, dirName string, depth int) {
+	fileInfos, err := getFileList(dirName)
+	if err != nil {
+		parent.Error(dirName, err)
+	}
 	fiCount := len(fileInfos)
 
 	progressChunk, progressExtra := splitProgressValue(progressValue, fiCount)
 
 	for i := 0; i < fiCount; i++ {
+		if errorLog.Stopped() {
+			break
+		}
 		name := fileInfos[i].Name()
 		fullName := filepath.Join(dirName, name)
 		isDir := fileInfos[i].IsDir()
 
-		if (isDir && cfg.ignoreSpecificDirs[fullName]) || (!isDir && cfg.ignoreFiles[name]) {
+		if cfg.isIgnored(entryIdx, fullName, fileInfos[i]) {
 			stats.lock.Lock()
 			stats.progress += progressChunk
 			stats.ignored++
@@ -208,68 +342,41 @@ func useDB(cfg *Config, progressValue float64, dirName string, depth int) {
 		stats.currentPath = fullName
 		stats.lock.Unlock()
 
-		var deltaMatched, deltaMissing, deltaCopied int
 		if isDir {
 			if depth != 0 {
-				useDB(cfg, progressChunk, fullName, depth-1)
-				continue // Progress was already incremented
+				// Let a worker walk the subdirectory, while we keep on walking this one
+				sub := parent.Nest()
+				workPool.Run(func() {
+					useDB(cfg, sub, progressChunk, entryIdx, fullName, depth-1)
+					sub.Done()
+				})
+				continue // Progress gets incremented by useDB
 			}
+		} else if !fileInfos[i].Mode().IsRegular() {
+			// Symlinks and special files have no contents of their own to keep track of,
+			// and opening them might block forever or read a whole device
 		} else {
-			// Compare file hashes
-			hash, _ := hashFile(fullName)
-			//writeToConsole("OK %.4f MB/s %x %v", speed, hash, fullName)
-
-			if cfg.buildDB {
-				// Write out the DB entry
-				if ensureDBEntry(cfg.entries[1], hash, fullName) {
-					deltaCopied++
-				} else {
-					deltaMatched++
-				}
-			} else if cfg.checkDB {
-				// Check if the DB entry exists
-				if !hasDBEntry(cfg.entries[0], hash) {
-					// Copy it if requested
-					if len(cfg.copy) > 0 {
-						// TODO: Rewrite the function to keep track of either the base entry or something like that,
-						//       instead of this scanning to figure it out.
-						suffix := ""
-						for _, entry := range cfg.entries {
-							if strings.HasPrefix(fullName, entry) {
-								suffix = fullName[len(entry):]
-								break
-							}
-						}
-						if suffix == "" {
-							panic("Didn't find entry prefix!")
-						}
-						dst := filepath.Join(cfg.copy, suffix)
-						if err := os.MkdirAll(filepath.Dir(dst), 0666); err != nil {
-							writeToConsole("Failed to create directory %v because: %v", filepath.Dir(dst), err)
-							panic("")
-						}
-						if err := copyFile(fullName, dst); err != nil {
-							writeToConsole("Failed to copy %v to %v because: %v", fullName, dst, err)
-							panic("")
-						}
-						reportMismatch("COPIED %v", fullName)
-						deltaCopied++
-					} else {
-						reportMismatch("MISSING %v", fullName)
-						deltaMissing++
-					}
-				} else {
-					deltaMatched++
-				}
-			}
+			// Let a worker deal with the file, while we keep on walking
+			out := parent.Nest()
+			replica := Replica{idx: entryIdx, path: fullName, info: fileInfos[i]}
+			workPool.Run(func() {
+				deltaMatched, deltaMissing, deltaCopied := useDBFile(cfg, out, &replica)
+				out.Done()
+
+				// Increment the progress
+				stats.lock.Lock()
+				stats.progress += progressChunk
+				stats.matched += deltaMatched
+				stats.missing += deltaMissing
+				stats.copied += deltaCopied
+				stats.lock.Unlock()
+			})
+			continue
 		}
 
 		// Increment the progress
 		stats.lock.Lock()
 		stats.progress += progressChunk
-		stats.matched += deltaMatched
-		stats.missing += deltaMissing
-		stats.copied += deltaCopied
 		stats.lock.Unlock()
 	}
 
@@ -279,9 +386,367 @@ func useDB(cfg *Config, progressValue float64, dirName string, depth int) {
 	stats.lock.Unlock()
 }
 
-func compareDir(cfg *Config, progressValue float64, dirNames []string, depth int) {
+func allTrue(values []bool) bool {
+	for _, v := range values {
+		if !v {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns which of the hashes are equal to the first one
+func matchesSource(hashes [][]byte) []bool {
+	good := make([]bool, len(hashes))
+	for i := range hashes {
+		good[i] = bytes.Equal(hashes[0], hashes[i])
+	}
+	return good
+}
+
+// Groups equal hashes together and returns which of the hashes belong to the group that has more than half of them.
+// Returns nil if there is no such group, as then the copies can't be trusted to outvote the others.
+func findMajority(hashes [][]byte) []bool {
+	counts := make(map[string]int, len(hashes))
+	for i := range hashes {
+		counts[string(hashes[i])]++
+	}
+	best, bestCount, tie := "", 0, false
+	for hash, count := range counts {
+		if count > bestCount {
+			best, bestCount, tie = hash, count, false
+		} else if count == bestCount {
+			tie = true
+		}
+	}
+	if tie || bestCount*2 <= len(hashes) {
+		return nil
+	}
+	good := make([]bool, len(hashes))
+	for i := range hashes {
+		good[i] = string(hashes[i]) == best
+	}
+	return good
+}
+
+// Overwrites the copies that aren't good with a good copy.
+// Returns the number of copies that were successfully repaired.
+func repairCopies(out *Output, replicas []Replica, hashes [][]byte, good []bool) int {
+	src := -1
+	for i := range good {
+		if good[i] {
+			src = i
+			break
+		}
+	}
+	if src == -1 {
+		return 0
+	}
+	repaired := 0
+	for i := range replicas {
+		if errorLog.Stopped() {
+			break
+		}
+		if good[i] {
+			continue
+		}
+		if err := replaceFile(replicas[src].path, replicas[i].path); err != nil {
+			out.Error(replicas[i].path, fmt.Errorf("Failed to repair from %v because: %v", replicas[src].path, err))
+			continue
+		}
+		// Make sure the new contents actually made it to the disk, bypassing any cached hashes
+		release := ioScheduler.Acquire(replicas[i].path, nil)
+		hash, _, err := hashFile(replicas[i].path)
+		release()
+		if err != nil {
+			out.Error(replicas[i].path, fmt.Errorf("Failed to verify repair because: %v", err))
+			continue
+		} else if !bytes.Equal(hash, hashes[src]) {
+			out.Error(replicas[i].path, fmt.Errorf("Failed to repair from %v because the hash is still wrong", replicas[src].path))
+			continue
+		}
+		ev := newEvent("REPAIRED", &replicas[src], &replicas[i])
+		ev.SourceHash = fmt.Sprintf("%x", hashes[src])
+		ev.TargetHash = fmt.Sprintf("%x", hash)
+		ev.TargetSize = ev.SourceSize // The old size is no longer accurate
+		out.Mismatch(ev)
+		repaired++
+	}
+	return repaired
+}
+
+// Compares the contents of the files, where the first one is the source.
+// Returns the changes to the matched, mismatched and repaired counts.
+func compareFiles(cfg *Config, out *Output, allReplicas []Replica) (deltaMatched, deltaMismatched, deltaRepaired int) {
+	// Compare file hashes
+	hashes := make([][]byte, len(allReplicas))
+	speeds := make([]float64, len(allReplicas))
+	errs := make([]error, len(allReplicas))
+
+	var wg sync.WaitGroup
+	wg.Add(len(allReplicas))
+	for idx := range allReplicas {
+		go func(idx int) {
+			hashes[idx], speeds[idx], errs[idx] = hashReplica(&allReplicas[idx])
+			wg.Done()
+		}(idx)
+	}
+	wg.Wait()
+
+	// Leave out any copies that we failed to read
+	replicas := allReplicas[:0:0]
+	for idx := range allReplicas {
+		if errs[idx] != nil {
+			out.Error(allReplicas[idx].path, errs[idx])
+			if idx > 0 {
+				deltaMatched--
+			}
+			continue
+		}
+		replicas = append(replicas, allReplicas[idx])
+		hashes[len(replicas)-1] = hashes[idx]
+		speeds[len(replicas)-1] = speeds[idx]
+	}
+	hashes, speeds = hashes[:len(replicas)], speeds[:len(replicas)]
+	if errs[0] != nil {
+		// Without the source the targets can't be verified
+		deltaMatched -= len(replicas)
+		return
+	}
+
+	// By default the source is the truth, but with enough copies we can let them vote
+	good, label, agreed := matchesSource(hashes), "WRONG HASH", true
+	if cfg.majority {
+		var majority []bool
+		if len(hashes) > 2 {
+			majority = findMajority(hashes)
+		} else if allTrue(good) {
+			majority = good // The copies that are left all agree, so there's nothing to vote on
+		}
+		if majority != nil {
+			good, label = majority, "CORRUPT"
+		} else {
+			// Either the vote was tied, or too few copies could be read to outvote the source
+			agreed = false
+			ev := newEvent("NO MAJORITY", &replicas[0], nil)
+			ev.SourceHash = fmt.Sprintf("%x", hashes[0])
+			out.Mismatch(ev)
+		}
+	}
+	ref := 0 // The copy that has the good contents
+	for !good[ref] {
+		ref++
+	}
+	newHashEvent := func(eventType string, idx int) *Event {
+		ev := newEvent(eventType, &replicas[ref], &replicas[idx])
+		ev.SourceHash = fmt.Sprintf("%x", hashes[ref])
+		ev.TargetHash = fmt.Sprintf("%x", hashes[idx])
+		return ev
+	}
+	if !good[0] {
+		deltaMismatched++
+		out.Mismatch(newHashEvent(label, 0))
+	}
+
+	avgSpeed := speeds[0]
+	for j := 1; j < len(hashes); j++ {
+		if !good[j] {
+			deltaMatched--
+			deltaMismatched++
+			out.Mismatch(newHashEvent(label, j))
+		} else {
+			out.Match(newHashEvent("MATCH", j))
+		}
+		avgSpeed += speeds[j]
+	}
+	avgSpeed /= float64(len(speeds))
+
+	if cfg.repair && agreed {
+		deltaRepaired = repairCopies(out, replicas, hashes, good)
+	}
+
+	//writeToConsole("OK %.4f MB/s %x %v", avgSpeed, hashes[0], replicas[0].path)
+	return
+}
+
+// Compares the file sizes without reading any contents
+func compareQuick(cfg *Config, out *Output, replicas []Replica) (deltaMatched, deltaMismatched int) {
+	src := &replicas[0]
+	for j := 1; j < len(replicas); j++ {
+		dst := &replicas[j]
+		if src.info.Size() != dst.info.Size() {
+			deltaMatched--
+			deltaMismatched++
+			out.Mismatch(newEvent("SIZE DIFFERS", src, dst))
+		} else {
+			out.Match(newEvent("MATCH", src, dst))
+		}
+	}
+	return
+}
+
+// Compares where the symlinks point to, without following them
+func compareLinks(out *Output, replicas []Replica) (deltaMatched, deltaMismatched int) {
+	src := &replicas[0]
+	srcTarget, err := os.Readlink(src.path)
+	if err != nil {
+		out.Error(src.path, err)
+		deltaMatched -= len(replicas) - 1
+		return
+	}
+	for j := 1; j < len(replicas); j++ {
+		dst := &replicas[j]
+		dstTarget, err := os.Readlink(dst.path)
+		if err != nil {
+			out.Error(dst.path, err)
+			deltaMatched--
+		} else if dstTarget != srcTarget {
+			deltaMatched--
+			deltaMismatched++
+			out.Mismatch(newMetaEvent("LINK DIFFERS", src, dst, srcTarget, dstTarget))
+		} else {
+			out.Match(newEvent("MATCH", src, dst))
+		}
+	}
+	return
+}
+
+// Replaces the symlinks in the file lists with what they point to.
+// Broken links are reported and kept as symlinks.
+func followSymlinks(out *Output, dirs []Replica, allFileInfos [][]os.FileInfo) (deltaBroken int) {
+	for j := range allFileInfos {
+		for k, info := range allFileInfos[j] {
+			if info.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			replica := Replica{idx: dirs[j].idx, path: filepath.Join(dirs[j].path, info.Name()), info: info}
+			target, err := os.Stat(replica.path)
+			if err == nil {
+				allFileInfos[j][k] = target
+				continue
+			}
+			deltaBroken++
+			var ev *Event
+			if j == 0 {
+				ev = newEvent("BROKEN LINK", &replica, nil)
+			} else {
+				ev = newEvent("BROKEN LINK", nil, &replica)
+			}
+			ev.Error = err.Error()
+			out.Mismatch(ev)
+		}
+	}
+	return
+}
+
+// Compares special files by their type, which already matches, and their device numbers.
+// They are never opened, as e.g. opening a FIFO blocks until someone writes to it.
+func compareSpecial(out *Output, replicas []Replica) (deltaMatched, deltaMismatched int) {
+	src := &replicas[0]
+	srcDevice, _ := deviceNumber(src.info)
+	for j := 1; j < len(replicas); j++ {
+		dst := &replicas[j]
+		if dstDevice, _ := deviceNumber(dst.info); dstDevice != srcDevice {
+			deltaMatched--
+			deltaMismatched++
+			out.Mismatch(newMetaEvent("DEVICE DIFFERS", src, dst, srcDevice, dstDevice))
+		} else {
+			out.Match(newEvent("MATCH", src, dst))
+		}
+	}
+	return
+}
+
+// A target has lost its sparseness once it takes up this much more disk space than the source
+const (
+	sparseFactor = 2
+	sparseMargin = 1048576 // 1 MiB
+)
+
+// Reports the targets that take up far more disk space than the source, e.g. because a copy filled in the holes.
+// Returns the number of such targets.
+func compareSparseness(out *Output, replicas []Replica) (deltaMismatched int) {
+	src := &replicas[0]
+	srcAllocated, ok := allocatedSize(src.info)
+	if !ok || srcAllocated >= src.info.Size() {
+		return // Nothing to lose
+	}
+	for j := 1; j < len(replicas); j++ {
+		dst := &replicas[j]
+		dstAllocated, ok := allocatedSize(dst.info)
+		if ok && dstAllocated > sparseFactor*srcAllocated && dstAllocated-srcAllocated > sparseMargin {
+			deltaMismatched++
+			out.Mismatch(newMetaEvent("LOST SPARSENESS", src, dst, formatSize(srcAllocated), formatSize(dstAllocated)))
+		}
+	}
+	return
+}
+
+// Returns the kind of the entry, which has to be the same for all copies
+func entryKind(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		return "DIR"
+	case mode&os.ModeSymlink != 0:
+		return "SYMLINK"
+	case mode&os.ModeNamedPipe != 0:
+		return "FIFO"
+	case mode&os.ModeSocket != 0:
+		return "SOCKET"
+	case mode&os.ModeCharDevice != 0:
+		return "CHAR DEVICE"
+	case mode&os.ModeDevice != 0:
+		return "BLOCK DEVICE"
+	}
+	return "FILE"
+}
+
+// Returns whether it's a FIFO, socket or device, which don't have any contents to compare
+func isSpecial(info os.FileInfo) bool {
+	return info.Mode()&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice) != 0
+}
+
+// The results are nested into parent, which the caller has to mark as done.
+// The ancestors are the real paths of the source directories above this one,
+// which are only tracked when following symlinks.
+func compareDir(cfg *Config, parent *Output, progressValue float64, dirs []Replica, depth int, ancestors []string) {
+	// Following symlinks could lead us back to where we already are
+	if cfg.followSymlinks {
+		if realPath, err := filepath.EvalSymlinks(dirs[0].path); err == nil {
+			for _, ancestor := range ancestors {
+				if ancestor == realPath {
+					out := parent.Nest()
+					out.Mismatch(newEvent("SYMLINK LOOP", &dirs[0], nil))
+					out.Done()
+					stats.lock.Lock()
+					stats.progress += progressValue
+					stats.mismatched++
+					stats.lock.Unlock()
+					return
+				}
+			}
+			ancestors = append(ancestors[:len(ancestors):len(ancestors)], realPath)
+		}
+	}
+
 	// Get the file list for this directory
-	allFileInfos := getFileLists(dirNames)
+	out := parent.Nest()
+	readDirs, allFileInfos := getFileLists(out, dirs)
+	deltaBroken := 0
+	if cfg.followSymlinks && len(readDirs) > 0 {
+		deltaBroken = followSymlinks(out, readDirs, allFileInfos)
+	}
+	out.Done()
+	if len(readDirs) == 0 || readDirs[0].idx != dirs[0].idx {
+		// Without the source there's nothing to compare against
+		stats.lock.Lock()
+		stats.progress += progressValue
+		stats.mismatched += deltaBroken
+		stats.lock.Unlock()
+		return
+	}
+	dirs = readDirs
 
 	// Make sure they match
 	fiCount := len(allFileInfos[0])
@@ -289,11 +754,14 @@ func compareDir(cfg *Config, progressValue float64, dirNames []string, depth int
 	progressChunk, progressExtra := splitProgressValue(progressValue, fiCount)
 
 	for i := 0; i < fiCount; i++ {
+		if errorLog.Stopped() {
+			break
+		}
 		name := allFileInfos[0][i].Name()
-		fullName := filepath.Join(dirNames[0], name)
+		fullName := filepath.Join(dirs[0].path, name)
 		isDir := allFileInfos[0][i].IsDir()
 
-		if (isDir && cfg.ignoreSpecificDirs[fullName]) || (!isDir && cfg.ignoreFiles[name]) {
+		if cfg.isIgnored(dirs[0].idx, fullName, allFileInfos[0][i]) {
 			stats.lock.Lock()
 			stats.progress += progressChunk
 			stats.ignored++
@@ -307,77 +775,101 @@ func compareDir(cfg *Config, progressValue float64, dirNames []string, depth int
 
 		var deltaMatched, deltaMismatched, deltaMissing int
 
-		allNames := make([]string, 0, len(allFileInfos))
-		allNames = append(allNames, fullName)
+		out := parent.Nest()
+		src := Replica{idx: dirs[0].idx, path: fullName, info: allFileInfos[0][i]}
+		kind := entryKind(src.info)
+		allReplicas := make([]Replica, 0, len(allFileInfos))
+		allReplicas = append(allReplicas, src)
 		for j := 1; j < len(allFileInfos); j++ {
-			searchName := filepath.Join(dirNames[j], name)
+			searchName := filepath.Join(dirs[j].path, name)
 			found, dirMismatch := false, false
 			for k := 0; k < len(allFileInfos[j]); k++ {
 				n := allFileInfos[j][k].Name()
 				if n == name {
-					if allFileInfos[j][k].IsDir() == isDir {
+					dst := Replica{idx: dirs[j].idx, path: searchName, info: allFileInfos[j][k]}
+					if entryKind(allFileInfos[j][k]) == kind {
 						found = true
 						deltaMatched++
-						allNames = append(allNames, searchName)
+						allReplicas = append(allReplicas, dst)
+						if isDir || cfg.noData {
+							out.Match(newEvent("MATCH", &src, &dst))
+						}
+						if len(cfg.meta) > 0 {
+							deltaMismatched += compareMeta(cfg, out, &src, &dst)
+						}
 					} else {
 						dirMismatch = true
 						deltaMismatched++
-						if isDir {
-							reportMismatch("EXPECTED DIR %v", searchName)
-						} else {
-							reportMismatch("EXPECTED FILE %v", searchName)
-						}
+						out.Mismatch(newEvent("EXPECTED "+kind, &src, &dst))
 					}
 					break
 				}
 			}
 			if !found && !dirMismatch {
 				deltaMissing++
-				reportMismatch("MISSING %v", searchName)
+				out.Mismatch(newEvent("MISSING", &src, &Replica{idx: dirs[j].idx, path: searchName}))
 			}
 		}
 
-		if len(allNames) > 1 {
-			if isDir {
-				if depth != 0 {
-					compareDir(cfg, progressChunk, allNames, depth-1)
-					stats.lock.Lock()
-					stats.matched += deltaMatched
-					stats.mismatched += deltaMismatched
-					stats.missing += deltaMissing
-					stats.lock.Unlock()
-					continue // Progress was already incremented by compareDir
-				}
-			} else if !cfg.noData {
-				// Compare file hashes
-				hashes := make([][]byte, len(allNames))
-				speeds := make([]float64, len(allNames))
-
-				var wg sync.WaitGroup
-				wg.Add(len(allNames))
-				for idx, name := range allNames {
-					go func(idx int, name string) {
-						hashes[idx], speeds[idx] = hashFile(name)
-						wg.Done()
-					}(idx, name)
-				}
-				wg.Wait()
-
-				hash := hashes[0]
-				avgSpeed := speeds[0]
-				for j := 1; j < len(hashes); j++ {
-					if !bytes.Equal(hash, hashes[j]) {
-						deltaMatched--
-						deltaMismatched++
-						reportMismatch("WRONG HASH %v", allNames[j])
-					}
-					avgSpeed += speeds[j]
-				}
-				avgSpeed /= float64(len(speeds))
+		if cfg.hardlinks && kind == "FILE" && len(allReplicas) > 1 {
+			deltaMismatched += hardlinks.Check(out, allReplicas)
+		}
+		if cfg.sparse && kind == "FILE" && len(allReplicas) > 1 {
+			deltaMismatched += compareSparseness(out, allReplicas)
+		}
 
-				//writeToConsole("OK %.4f MB/s %x %v", avgSpeed, hash, allNames[0])
+		if len(allReplicas) > 1 && kind == "SYMLINK" && !cfg.noData {
+			dMatched, dMismatched := compareLinks(out, allReplicas)
+			deltaMatched += dMatched
+			deltaMismatched += dMismatched
+		} else if len(allReplicas) > 1 && isSpecial(src.info) {
+			if !cfg.noData {
+				dMatched, dMismatched := compareSpecial(out, allReplicas)
+				deltaMatched += dMatched
+				deltaMismatched += dMismatched
 			}
+		} else if len(allReplicas) > 1 && !isDir && cfg.quick {
+			dMatched, dMismatched := compareQuick(cfg, out, allReplicas)
+			deltaMatched += dMatched
+			deltaMismatched += dMismatched
+		} else if len(allReplicas) > 1 && !isDir && !cfg.noData {
+			// Let a worker compare the contents, while we keep on walking
+			workPool.Run(func() {
+				stats.lock.Lock()
+				stats.currentPath = fullName
+				stats.lock.Unlock()
+
+				dMatched, dMismatched, dRepaired := compareFiles(cfg, out, allReplicas)
+				out.Done()
+
+				// Increment the progress
+				stats.lock.Lock()
+				stats.progress += progressChunk
+				stats.matched += deltaMatched + dMatched
+				stats.mismatched += deltaMismatched + dMismatched
+				stats.missing += deltaMissing
+				stats.repaired += dRepaired
+				stats.lock.Unlock()
+			})
+			continue
+		}
+		out.Done()
+
+		if len(allReplicas) > 1 && isDir && depth != 0 {
+			// Let a worker walk the subdirectory, while we keep on walking this one
+			sub := parent.Nest()
+			workPool.Run(func() {
+				compareDir(cfg, sub, progressChunk, allReplicas, depth-1, ancestors)
+				sub.Done()
+				stats.lock.Lock()
+				stats.matched += deltaMatched
+				stats.mismatched += deltaMismatched
+				stats.missing += deltaMissing
+				stats.lock.Unlock()
+			})
+			continue // Progress gets incremented by compareDir
 		}
+
 		// Increment the progress
 		stats.lock.Lock()
 		stats.progress += progressChunk
@@ -387,74 +879,35 @@ func compareDir(cfg *Config, progressValue float64, dirNames []string, depth int
 		stats.lock.Unlock()
 	}
 
-	stats.lock.Lock()
-	stats.currentPath = ""
-	stats.progress += progressExtra
-	stats.lock.Unlock()
-}
-
-func deleteDupes(cfg *Config, progressValue float64, dirName string, depth int, hashes map[[32]byte]struct{}) {
-	fileInfos := getFileList(dirName)
-	fiCount := len(fileInfos)
-
-	progressChunk, progressExtra := splitProgressValue(progressValue, fiCount)
-
-	for i := 0; i < fiCount; i++ {
-		name := fileInfos[i].Name()
-		fullName := filepath.Join(dirName, name)
-		isDir := fileInfos[i].IsDir()
-
-		if (isDir && cfg.ignoreSpecificDirs[fullName]) || (!isDir && cfg.ignoreFiles[name]) {
-			stats.lock.Lock()
-			stats.progress += progressChunk
-			stats.ignored++
-			stats.lock.Unlock()
-			continue
+	// Report anything that exists in the targets but not in the source
+	deltaExtra := 0
+	if cfg.strict {
+		out := parent.Nest()
+		sourceNames := make(map[string]struct{}, fiCount)
+		for i := 0; i < fiCount; i++ {
+			sourceNames[allFileInfos[0][i].Name()] = struct{}{}
 		}
-
-		stats.lock.Lock()
-		stats.currentPath = fullName
-		stats.lock.Unlock()
-
-		var deltaMatched, deltaMismatched int
-		if isDir {
-			if depth != 0 {
-				deleteDupes(cfg, progressChunk, fullName, depth-1, hashes)
-				continue // Progress was already incremented
-			}
-		} else {
-			// Compare file hashes
-			hash, _ := hashFile(fullName)
-			//writeToConsole("OK %.4f MB/s %x %v", speed, hash, fullName)
-
-			var h [32]byte
-			copy(h[:], hash[:])
-
-			if _, ok := hashes[h]; ok {
-				// Duplicate
-				deltaMatched++
-				//reportMismatch("DUPE %v", fullName)
-				if err := os.Remove(fullName); err != nil {
-					writeToConsole("Failed to delete %v because: %v", fullName, err)
-					panic("")
+		for j := 1; j < len(allFileInfos); j++ {
+			for k := 0; k < len(allFileInfos[j]); k++ {
+				name := allFileInfos[j][k].Name()
+				if _, ok := sourceNames[name]; ok {
+					continue
 				}
-			} else {
-				// New entry
-				deltaMismatched++
-				hashes[h] = struct{}{}
+				fullName := filepath.Join(dirs[j].path, name)
+				if cfg.isIgnored(dirs[j].idx, fullName, allFileInfos[j][k]) {
+					continue
+				}
+				deltaExtra++
+				dst := Replica{idx: dirs[j].idx, path: fullName, info: allFileInfos[j][k]}
+				out.Mismatch(newEvent("EXTRA "+entryKind(dst.info), nil, &dst))
 			}
 		}
-
-		// Increment the progress
-		stats.lock.Lock()
-		stats.progress += progressChunk
-		stats.matched += deltaMatched
-		stats.mismatched += deltaMismatched
-		stats.lock.Unlock()
+		out.Done()
 	}
 
 	stats.lock.Lock()
-	stats.currentPath = ""
 	stats.progress += progressExtra
+	stats.extra += deltaExtra
+	stats.mismatched += deltaBroken
 	stats.lock.Unlock()
 }
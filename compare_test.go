@@ -0,0 +1,54 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestFindMajority(t *testing.T) {
+	tests := []struct {
+		hashes []string
+		good   []bool // nil when there is no majority
+	}{
+		{[]string{"a", "a", "a"}, []bool{true, true, true}},
+		{[]string{"a", "a", "b"}, []bool{true, true, false}},
+		{[]string{"b", "a", "a"}, []bool{false, true, true}},
+		{[]string{"a", "b", "c"}, nil},
+		{[]string{"a", "a", "b", "b"}, nil},
+		{[]string{"a", "a", "b", "c"}, nil},
+		{[]string{"a", "b", "b", "b"}, []bool{false, true, true, true}},
+		{[]string{"a", "b"}, nil},
+		{[]string{"a", "a", "b", "b", "c"}, nil},
+		{[]string{"a", "a", "a", "b", "c"}, []bool{true, true, true, false, false}},
+	}
+	for _, test := range tests {
+		hashes := make([][]byte, len(test.hashes))
+		for i := range test.hashes {
+			hashes[i] = []byte(test.hashes[i])
+		}
+		good := findMajority(hashes)
+		if (good == nil) != (test.good == nil) || len(good) != len(test.good) {
+			t.Errorf("findMajority(%q) = %v, expected %v", test.hashes, good, test.good)
+			continue
+		}
+		for i := range good {
+			if good[i] != test.good[i] {
+				t.Errorf("findMajority(%q) = %v, expected %v", test.hashes, good, test.good)
+				break
+			}
+		}
+	}
+}
@@ -15,13 +15,54 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
 	"golang.org/x/crypto/blake2b"
 )
 
+const defaultHashAlgorithm = "blake2b-256"
+
+var hashAlgorithms = map[string]func() (hash.Hash, error){
+	"blake2b-256": func() (hash.Hash, error) { return blake2b.New256(nil) },
+	"blake2b-512": func() (hash.Hash, error) { return blake2b.New512(nil) },
+	"sha256":      func() (hash.Hash, error) { return sha256.New(), nil },
+	"sha1":        func() (hash.Hash, error) { return sha1.New(), nil },
+	"md5":         func() (hash.Hash, error) { return md5.New(), nil },
+	"crc32c":      func() (hash.Hash, error) { return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil },
+}
+
+// Algorithms that are too collision prone to decide that two files are identical
+var weakHashAlgorithms = map[string]bool{
+	"crc32c": true,
+}
+
+// The algorithm used by all hashing, one of hashAlgorithms
+var hashAlgorithm = defaultHashAlgorithm
+
+func getHashAlgorithmNames() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newHash() (hash.Hash, error) {
+	return hashAlgorithms[hashAlgorithm]()
+}
+
 // TODO: Improve the function to:
 //       #1 Copy also metadata like time created & time modified & access lists & possibly alternate streams
 //       #2 Copy it in chunks to be able to report copying speed to the stats engine
@@ -49,33 +90,227 @@ func copyFile(src, dst string) error {
 	return out.Close()
 }
 
-// Returns hash, MB/s
-func hashFile(name string) ([]byte, float64) {
-	t1 := time.Now()
-	totalBytes := 0
+// Moves the file, falling back to copying when it has to go to another device.
+// An existing dst is never replaced.
+func moveFile(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%v already exists", dst)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(src, dst); !isCrossDevice(err) {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
 
-	h, err := blake2b.New256(nil)
+// Atomically replaces dst with a new file that gets its contents from fill.
+// The new file is first written next to dst and then renamed over dst,
+// keeping the permissions, owner and extended attributes of dst.
+func replaceFileWith(dst string, modTime time.Time, fill func(out *os.File) error) error {
+	dstInfo, err := os.Stat(dst)
 	if err != nil {
-		writeToConsole("Failed to create blake2b hash: %v", err)
-		panic("")
+		return err
 	}
 
+	out, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".brahe-")
+	if err != nil {
+		return err
+	}
+	tmpName := out.Name()
+	defer os.Remove(tmpName) // Only matters when we fail before the rename
+	defer out.Close()        // Defer it to be sure it's closed, although we'll manually close it in a good scenario
+
+	if err = fill(out); err != nil {
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	// Change the owner first, as that may clear the setuid and setgid bits
+	if uid, gid, ok := fileOwner(dstInfo); ok {
+		if err = os.Chown(tmpName, int(uid), int(gid)); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Chmod(tmpName, dstInfo.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if err = copyXattrs(dst, tmpName); err != nil {
+		return err
+	}
+
+	if err = os.Chtimes(tmpName, modTime, modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, dst)
+}
+
+// Atomically replaces the contents of dst with the contents of src
+func replaceFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	srcInfo, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	return replaceFileWith(dst, srcInfo.ModTime(), func(out *os.File) error {
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+		return out.Sync()
+	})
+}
+
+// Atomically replaces dst with a copy-on-write clone of src, keeping the modification time of dst
+func reflinkFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+
+	return replaceFileWith(dst, dstInfo.ModTime(), func(out *os.File) error {
+		return cloneFile(out, in)
+	})
+}
+
+// Atomically replaces dst with a hard link to src
+func linkFile(src, dst string) error {
+	// Reserve a temporary name next to dst
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".brahe-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	if err = os.Remove(tmpName); err != nil {
+		return err
+	}
+
+	if err = os.Link(src, tmpName); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, dst); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// Hashes only the first and last n bytes of the file
+func hashFileEnds(name string, n int64) ([]byte, error) {
+	h, err := newHash()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create %v hash: %v", hashAlgorithm, err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(h, f, n); err != nil {
+		return nil, fmt.Errorf("Failed reading file: %v", err)
+	}
+	if _, err := f.Seek(-n, io.SeekEnd); err != nil {
+		return nil, fmt.Errorf("Failed seeking file: %v", err)
+	}
+	if _, err := io.CopyN(h, f, n); err != nil {
+		return nil, fmt.Errorf("Failed reading file: %v", err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// Holes in sparse files are hashed as zeros without reading them
+var zeros = make([]byte, 4194304) // 4 MiB
+
+func hashZeros(h hash.Hash, n int64) {
+	for n > 0 {
+		chunk := int64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		h.Write(zeros[:chunk])
+		n -= chunk
+	}
+}
+
+// Returns hash, MB/s
+func hashFile(name string) ([]byte, float64, error) {
 	f, err := os.Open(name)
 	if err != nil {
-		writeToConsole("Failed to open file: %v - %v", name, err)
-		panic("")
+		return nil, 0, fmt.Errorf("Failed to open file: %v", err)
 	}
 	defer f.Close()
+	return hashOpenFile(f)
+}
+
+// Hashes the already opened file from the start.
+// Returns hash, MB/s
+func hashOpenFile(f *os.File) ([]byte, float64, error) {
+	t1 := time.Now()
+	totalBytes := int64(0)
+
+	h, err := newHash()
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to create %v hash: %v", hashAlgorithm, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to stat file: %v", err)
+	}
+	size := info.Size()
 
 	buff := make([]byte, 4194304) // 4 MiB
+	for offset := int64(0); offset < size; {
+		data, hole, err := nextDataRegion(f, offset, size)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Failed seeking file: %v", err)
+		}
+		hashZeros(h, data-offset)
+		n, err := io.CopyBuffer(h, io.LimitReader(f, hole-data), buff)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Failed reading file: %v", err)
+		}
+		totalBytes += data - offset + n
+		offset = data + n
+		if n < hole-data {
+			break // The file shrunk
+		}
+	}
+	// Read anything that was appended while we were hashing
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("Failed seeking file: %v", err)
+	}
 	for {
 		n, err := f.Read(buff)
-		totalBytes += n
+		totalBytes += int64(n)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			writeToConsole("Failed reading file: %v - %v", name, err)
-			panic("")
+			return nil, 0, fmt.Errorf("Failed reading file: %v", err)
 		}
 		h.Write(buff[:n])
 	}
@@ -88,5 +323,5 @@ func hashFile(name string) ([]byte, float64) {
 
 	///writeToConsole("Hashed %v in %v - %v MB/s", name, dur, MBps)
 
-	return result, MBps
+	return result, MBps, nil
 }
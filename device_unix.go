@@ -0,0 +1,45 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Returns an identifier of the device that the file is on
+func deviceOf(path string, info os.FileInfo) (string, error) {
+	if info == nil {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			return "", err
+		}
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("No device information for %v", path)
+	}
+	return fmt.Sprintf("%d", uint64(st.Dev)), nil
+}
+
+// Returns true if the rename failed because it was across devices
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == syscall.EXDEV
+}
@@ -0,0 +1,34 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Returns an identifier of the device that the file is on
+func deviceOf(path string, info os.FileInfo) (string, error) {
+	return strings.ToUpper(filepath.VolumeName(path)), nil
+}
+
+// Returns true if the rename failed because it was across volumes
+func isCrossDevice(err error) bool {
+	const errorNotSameDevice = syscall.Errno(17) // ERROR_NOT_SAME_DEVICE
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == errorNotSameDevice
+}
@@ -0,0 +1,403 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DupeGroup is a group of files that are equal as far as the last grouping key can tell.
+// After the full hash stage the key is the hash of the contents.
+type DupeGroup struct {
+	key      string
+	replicas []Replica
+}
+
+// Only the first and last this many bytes of a file are read for the partial hash
+const partialHashSize = 2 * 1024 * 1024 // 2 MiB
+
+const (
+	KeepFirst    = "first"
+	KeepOldest   = "oldest"
+	KeepNewest   = "newest"
+	KeepShortest = "shortest"
+	KeepDeepest  = "deepest"
+)
+
+var keepPolicies = []string{KeepFirst, KeepOldest, KeepNewest, KeepShortest, KeepDeepest}
+
+const (
+	LinkHard    = "hard"
+	LinkReflink = "reflink"
+)
+
+// Returns the index of the first directory that contains the path, or len(dirs) if none do
+func containingDir(dirs []string, path string) int {
+	for i, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return i
+		}
+	}
+	return len(dirs)
+}
+
+// Returns true if a should be kept instead of b
+func keepInstead(cfg *Config, a, b *Replica) bool {
+	if rankA, rankB := containingDir(cfg.prefer, a.path), containingDir(cfg.prefer, b.path); rankA != rankB {
+		return rankA < rankB
+	}
+	switch cfg.keep {
+	case KeepOldest:
+		return a.info.ModTime().Before(b.info.ModTime())
+	case KeepNewest:
+		return a.info.ModTime().After(b.info.ModTime())
+	case KeepShortest:
+		return len(a.path) < len(b.path)
+	case KeepDeepest:
+		return strings.Count(a.path, string(filepath.Separator)) > strings.Count(b.path, string(filepath.Separator))
+	}
+	return false // Keep the first one found
+}
+
+// Returns true if duplicates at this path may be dealt with
+func isDupeTarget(cfg *Config, path string) bool {
+	return len(cfg.dupesIn) == 0 || containingDir(cfg.dupesIn, path) < len(cfg.dupesIn)
+}
+
+// Returns the index of the group member that should be kept.
+// Files outside of -dupes-in are always kept, so one of them is chosen when possible.
+func chooseKept(cfg *Config, group []Replica) int {
+	kept := -1
+	for i := range group {
+		if isDupeTarget(cfg, group[i].path) {
+			continue
+		}
+		if kept == -1 || keepInstead(cfg, &group[i], &group[kept]) {
+			kept = i
+		}
+	}
+	if kept != -1 {
+		return kept
+	}
+	kept = 0
+	for i := 1; i < len(group); i++ {
+		if keepInstead(cfg, &group[i], &group[kept]) {
+			kept = i
+		}
+	}
+	return kept
+}
+
+// Gets rid of the duplicate as configured, unless this is a dry run
+func removeDupe(cfg *Config, dupe, kept *Replica) error {
+	eventType := "DUPLICATE"
+	if cfg.dryRun {
+		// Only report it
+	} else if cfg.quarantine != "" {
+		rel, err := filepath.Rel(cfg.entries[dupe.idx], dupe.path)
+		if err != nil {
+			return err
+		}
+		if len(cfg.entries) > 1 {
+			// Keep the entries apart by mirroring their full paths, as their names alone might be the same
+			entry := cfg.entries[dupe.idx]
+			volume := filepath.VolumeName(entry)
+			rel = filepath.Join(strings.TrimSuffix(volume, ":"), entry[len(volume):], rel)
+		}
+		dst := filepath.Join(cfg.quarantine, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return fmt.Errorf("Failed to create directory %v because: %v", filepath.Dir(dst), err)
+		}
+		if err := moveFile(dupe.path, dst); err != nil {
+			return fmt.Errorf("Failed to move to %v because: %v", dst, err)
+		}
+		eventType = "QUARANTINED"
+	} else if cfg.link != "" {
+		if cfg.link == LinkHard {
+			if err := linkFile(kept.path, dupe.path); err != nil {
+				return fmt.Errorf("Failed to hard link because: %v", err)
+			}
+			eventType = "HARDLINKED"
+		} else {
+			if err := reflinkFile(kept.path, dupe.path); err != nil {
+				return fmt.Errorf("Failed to reflink because: %v", err)
+			}
+			eventType = "REFLINKED"
+		}
+	} else {
+		if err := os.Remove(dupe.path); err != nil {
+			return fmt.Errorf("Failed to delete because: %v", err)
+		}
+		eventType = "DELETED"
+	}
+	reportMismatch(newEvent(eventType, kept, dupe))
+	return nil
+}
+
+// Splits each group further into groups of files that share the same key.
+// Groups that end up with a single file are dropped and only counted as unique.
+func regroupFiles(progressValue float64, groups []DupeGroup, key func(replica *Replica) (string, error)) ([]DupeGroup, int) {
+	fileCount := 0
+	for i := range groups {
+		fileCount += len(groups[i].replicas)
+	}
+
+	progressChunk, progressExtra := splitProgressValue(progressValue, fileCount)
+
+	var newGroups []DupeGroup
+	unique := 0
+	for i := range groups {
+		if errorLog.Stopped() {
+			break
+		}
+		// Get the keys concurrently, but deal with the results in order
+		replicas := groups[i].replicas
+		replicaKeys := make([]string, len(replicas))
+		errs := make([]error, len(replicas))
+		workPool.ForEach(len(replicas), func(j int) {
+			stats.lock.Lock()
+			stats.currentPath = replicas[j].path
+			stats.lock.Unlock()
+
+			replicaKeys[j], errs[j] = key(&replicas[j])
+
+			stats.lock.Lock()
+			stats.progress += progressChunk
+			stats.lock.Unlock()
+		})
+
+		var keys []string
+		members := map[string][]Replica{}
+		for j := range replicas {
+			if errs[j] != nil {
+				reportError(replicas[j].path, errs[j])
+				continue
+			}
+			k := replicaKeys[j]
+			if _, ok := members[k]; !ok {
+				keys = append(keys, k)
+			}
+			members[k] = append(members[k], replicas[j])
+		}
+		for _, k := range keys {
+			if len(members[k]) > 1 {
+				newGroups = append(newGroups, DupeGroup{key: k, replicas: members[k]})
+			} else {
+				unique++
+			}
+		}
+	}
+
+	stats.lock.Lock()
+	stats.currentPath = ""
+	stats.progress += progressExtra
+	stats.lock.Unlock()
+
+	return newGroups, unique
+}
+
+// Finds the groups of files with equal contents.
+// To avoid reading all the data, files are first grouped by size and then by a partial hash.
+// Only the files that share both of those get fully hashed.
+// Returns the groups and the number of files with unique contents.
+func findDupeGroups(cfg *Config, progressValue float64) ([]DupeGroup, int) {
+	var files []Replica
+	progressChunk, progressExtra := splitProgressValue(progressValue*0.1, len(cfg.entries))
+	for i := range cfg.entries {
+		listFiles(cfg, progressChunk, i, cfg.entries[i], cfg.depth, &files)
+	}
+	stats.lock.Lock()
+	stats.progress += progressExtra
+	stats.lock.Unlock()
+
+	groups := []DupeGroup{{replicas: files}}
+	groups, uniqueBySize := regroupFiles(0, groups, func(replica *Replica) (string, error) {
+		return strconv.FormatInt(replica.info.Size(), 10), nil
+	})
+	groups, uniqueByPartial := regroupFiles(progressValue*0.2, groups, func(replica *Replica) (string, error) {
+		if replica.info.Size() <= 2*partialHashSize {
+			return "", nil // The full hash will read the whole file anyway
+		}
+		release := ioScheduler.Acquire(replica.path, replica.info)
+		defer release()
+		hash, err := hashFileEnds(replica.path, partialHashSize)
+		return string(hash), err
+	})
+	groups, uniqueByHash := regroupFiles(progressValue*0.7, groups, func(replica *Replica) (string, error) {
+		hash, _, err := hashReplica(replica)
+		//writeToConsole("OK %.4f MB/s %x %v", speed, hash, replica.path)
+		return string(hash), err
+	})
+
+	return groups, uniqueBySize + uniqueByPartial + uniqueByHash
+}
+
+func deleteDupes(cfg *Config, progressValue float64) {
+	groups, unique := findDupeGroups(cfg, progressValue)
+
+	stats.lock.Lock()
+	stats.mismatched += unique
+	stats.lock.Unlock()
+
+	for _, group := range groups {
+		if errorLog.Stopped() {
+			break
+		}
+		kept := chooseKept(cfg, group.replicas)
+
+		var deltaMatched int
+		for i := range group.replicas {
+			if errorLog.Stopped() {
+				break
+			}
+			// Hardlinks of the kept file would take its contents with them
+			if i == kept || !isDupeTarget(cfg, group.replicas[i].path) || os.SameFile(group.replicas[i].info, group.replicas[kept].info) {
+				continue
+			}
+			stats.lock.Lock()
+			stats.currentPath = group.replicas[i].path
+			stats.lock.Unlock()
+
+			if err := removeDupe(cfg, &group.replicas[i], &group.replicas[kept]); err != nil {
+				reportError(group.replicas[i].path, err)
+			} else {
+				deltaMatched++
+			}
+		}
+
+		stats.lock.Lock()
+		stats.matched += deltaMatched
+		stats.mismatched++
+		stats.lock.Unlock()
+	}
+
+	stats.lock.Lock()
+	stats.currentPath = ""
+	stats.lock.Unlock()
+}
+
+// Reports the groups of duplicates without modifying anything
+func findDupes(cfg *Config, progressValue float64) {
+	groups, unique := findDupeGroups(cfg, progressValue)
+
+	stats.lock.Lock()
+	stats.mismatched += unique
+	stats.lock.Unlock()
+
+	var totalWasted int64
+	groupCount := 0
+	for _, group := range groups {
+		kept := chooseKept(cfg, group.replicas)
+		size := group.replicas[0].info.Size()
+
+		// Hardlinks of the same file take up the space only once
+		paths := make([]string, 0, len(group.replicas))
+		removable := 0
+		inodes := []os.FileInfo{group.replicas[kept].info}
+		for i := range group.replicas {
+			paths = append(paths, group.replicas[i].path)
+			if i == kept || !isDupeTarget(cfg, group.replicas[i].path) || os.SameFile(group.replicas[i].info, group.replicas[kept].info) {
+				continue
+			}
+			removable++
+			seen := false
+			for _, info := range inodes {
+				seen = seen || os.SameFile(group.replicas[i].info, info)
+			}
+			if !seen {
+				inodes = append(inodes, group.replicas[i].info)
+			}
+		}
+
+		if removable > 0 {
+			wasted := size * int64(len(inodes)-1)
+			totalWasted += wasted
+			groupCount++
+			reportMismatch(&Event{
+				Type:   "DUPLICATES",
+				Hash:   fmt.Sprintf("%x", group.key),
+				Size:   &size,
+				Paths:  paths,
+				Wasted: &wasted,
+				Time:   time.Now(),
+			})
+		}
+
+		stats.lock.Lock()
+		stats.matched += removable
+		stats.mismatched++
+		stats.lock.Unlock()
+	}
+
+	writeToConsole("Found %v of reclaimable space in %d groups of duplicates.", formatSize(totalWasted), groupCount)
+	report.Write(&Event{Type: "RECLAIMABLE", Wasted: &totalWasted, Time: time.Now()})
+}
+
+// Recursively adds all the files in dirName to files
+func listFiles(cfg *Config, progressValue float64, entryIdx int, dirName string, depth int, files *[]Replica) {
+	fileInfos, err := getFileList(dirName)
+	if err != nil {
+		reportError(dirName, err)
+	}
+	fiCount := len(fileInfos)
+
+	progressChunk, progressExtra := splitProgressValue(progressValue, fiCount)
+
+	for i := 0; i < fiCount; i++ {
+		if errorLog.Stopped() {
+			break
+		}
+		name := fileInfos[i].Name()
+		fullName := filepath.Join(dirName, name)
+		isDir := fileInfos[i].IsDir()
+
+		if cfg.isIgnored(entryIdx, fullName, fileInfos[i]) {
+			stats.lock.Lock()
+			stats.progress += progressChunk
+			stats.ignored++
+			stats.lock.Unlock()
+			continue
+		}
+
+		stats.lock.Lock()
+		stats.currentPath = fullName
+		stats.lock.Unlock()
+
+		if isDir {
+			if depth != 0 {
+				listFiles(cfg, progressChunk, entryIdx, fullName, depth-1, files)
+				continue // Progress was already incremented
+			}
+		} else if fileInfos[i].Mode().IsRegular() {
+			// Symlinks and such aren't duplicates of the files they point to
+			*files = append(*files, Replica{idx: entryIdx, path: fullName, info: fileInfos[i]})
+		}
+
+		// Increment the progress
+		stats.lock.Lock()
+		stats.progress += progressChunk
+		stats.lock.Unlock()
+	}
+
+	stats.lock.Lock()
+	stats.currentPath = ""
+	stats.progress += progressExtra
+	stats.lock.Unlock()
+}
@@ -0,0 +1,76 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testFileInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (fi testFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func TestChooseKept(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2020, time.January, d, 0, 0, 0, 0, time.UTC)
+	}
+	group := []Replica{
+		{path: filepath.FromSlash("/a/x/y/one"), info: testFileInfo{modTime: day(2)}},
+		{path: filepath.FromSlash("/b/two"), info: testFileInfo{modTime: day(1)}},
+		{path: filepath.FromSlash("/a/three"), info: testFileInfo{modTime: day(3)}},
+		{path: filepath.FromSlash("/c/x/four"), info: testFileInfo{modTime: day(1)}},
+	}
+	tests := []struct {
+		keep    string
+		prefer  []string
+		dupesIn []string
+		kept    int
+	}{
+		{keep: KeepFirst, kept: 0},
+		{keep: KeepOldest, kept: 1},
+		{keep: KeepNewest, kept: 2},
+		{keep: KeepShortest, kept: 1},
+		{keep: KeepDeepest, kept: 0},
+		{keep: KeepFirst, prefer: []string{"/c"}, kept: 3},
+		{keep: KeepNewest, prefer: []string{"/b", "/a"}, kept: 1},
+		{keep: KeepNewest, prefer: []string{"/a"}, kept: 2},
+		{keep: KeepFirst, prefer: []string{"/d"}, kept: 0},
+		{keep: KeepFirst, dupesIn: []string{"/a"}, kept: 1},
+		{keep: KeepDeepest, dupesIn: []string{"/a"}, kept: 3},
+		{keep: KeepOldest, dupesIn: []string{"/a", "/b", "/c"}, kept: 1},
+		{keep: KeepShortest, prefer: []string{"/c"}, dupesIn: []string{"/a"}, kept: 3},
+	}
+	for _, test := range tests {
+		cfg := &Config{keep: test.keep}
+		for _, dir := range test.prefer {
+			cfg.prefer = append(cfg.prefer, filepath.FromSlash(dir))
+		}
+		for _, dir := range test.dupesIn {
+			cfg.dupesIn = append(cfg.dupesIn, filepath.FromSlash(dir))
+		}
+		if kept := chooseKept(cfg, group); kept != test.kept {
+			t.Errorf("chooseKept with -keep %v, -prefer %q and -dupes-in %q = %v, expected %v",
+				test.keep, test.prefer, test.dupesIn, kept, test.kept)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Returns what identifies this exact version of the file, if the platform can tell
+func fileIdentity(path string, info os.FileInfo) (FileID, bool) {
+	if info == nil {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			return FileID{}, false
+		}
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, false
+	}
+	return FileID{
+		dev:   uint64(st.Dev),
+		ino:   uint64(st.Ino),
+		size:  st.Size,
+		mtime: st.Mtimespec.Nano(),
+		ctime: st.Ctimespec.Nano(),
+	}, true
+}
+
+// Returns the device number of a device node, in its raw form as the encoding differs between systems
+func deviceNumber(info os.FileInfo) (string, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%#x", uint64(st.Rdev)), true
+}
+
+// Returns how many hardlinks the file has
+func hardlinkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 0
+}
+
+// Returns how much disk space is allocated for the file
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512, true
+	}
+	return 0, false
+}
@@ -0,0 +1,39 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package main
+
+import (
+	"os"
+)
+
+// Without inodes and change times there's no safe way to identify a file version
+func fileIdentity(path string, info os.FileInfo) (FileID, bool) {
+	return FileID{}, false
+}
+
+func deviceNumber(info os.FileInfo) (string, bool) {
+	return "", false
+}
+
+func hardlinkCount(info os.FileInfo) uint64 {
+	return 0
+}
+
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
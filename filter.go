@@ -0,0 +1,151 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Pattern is a glob that matches paths relative to the directory it applies to.
+// Patterns without a slash match names at any depth, while the others are anchored to the directory.
+// A trailing slash only matches directories and ** matches any number of directories.
+type Pattern struct {
+	segments []string
+	anchored bool
+	dirOnly  bool
+}
+
+func parsePattern(pattern string) (*Pattern, error) {
+	p := &Pattern{}
+	pattern = filepath.ToSlash(pattern)
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.HasPrefix(pattern, "/") {
+		p.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	} else if strings.Contains(pattern, "/") {
+		p.anchored = true
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("Empty pattern")
+	}
+	p.segments = strings.Split(pattern, "/")
+	for _, segment := range p.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return p, nil
+}
+
+// Returns whether the slash separated relative path matches
+func (p *Pattern) Match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	names := strings.Split(rel, "/")
+	if !p.anchored {
+		names = names[len(names)-1:]
+	}
+	return matchSegments(p.segments, names)
+}
+
+func matchSegments(segments, names []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(segments[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(segments[0], names[0]); !ok {
+			return false
+		}
+		segments, names = segments[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// Returns whether any of the patterns match the file or any of the directories it's in
+func matchesPath(patterns []*Pattern, rel string) bool {
+	for i := len(rel); i > 0; i = strings.LastIndexByte(rel[:i], '/') {
+		isDir := i < len(rel)
+		for _, p := range patterns {
+			if p.Match(rel[:i], isDir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type patternListValue struct {
+	list *[]*Pattern
+}
+
+func (plv *patternListValue) String() string {
+	return ""
+}
+
+func (plv *patternListValue) Set(value string) error {
+	p, err := parsePattern(value)
+	if err != nil {
+		return err
+	}
+	*plv.list = append(*plv.list, p)
+	return nil
+}
+
+// Returns whether the entry should be skipped, because of the built-in ignore lists, -skip-special,
+// the .braheignore files or -include/-exclude
+func (cfg *Config) isIgnored(entryIdx int, fullName string, info os.FileInfo) bool {
+	isDir := info.IsDir()
+	if (isDir && cfg.ignoreSpecificDirs[fullName]) || (!isDir && cfg.ignoreFiles[info.Name()]) {
+		return true
+	}
+	if cfg.skipSpecial && isSpecial(info) {
+		return true
+	}
+	if braheIgnore.Ignored(cfg.entries[entryIdx], fullName, isDir) {
+		return true
+	}
+	if len(cfg.includes) == 0 && len(cfg.excludes) == 0 {
+		return false
+	}
+
+	rel, err := filepath.Rel(cfg.entries[entryIdx], fullName)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, p := range cfg.excludes {
+		if p.Match(rel, isDir) {
+			return true
+		}
+	}
+	// Directories are always entered, as they might contain included files
+	return len(cfg.includes) > 0 && !isDir && !matchesPath(cfg.includes, rel)
+}
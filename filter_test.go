@@ -0,0 +1,130 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		segments []string
+		anchored bool
+		dirOnly  bool
+		fails    bool
+	}{
+		{pattern: "*.tmp", segments: []string{"*.tmp"}},
+		{pattern: "node_modules/", segments: []string{"node_modules"}, dirOnly: true},
+		{pattern: "/build", segments: []string{"build"}, anchored: true},
+		{pattern: "docs/*.md", segments: []string{"docs", "*.md"}, anchored: true},
+		{pattern: "**/cache/", segments: []string{"**", "cache"}, anchored: true, dirOnly: true},
+		{pattern: "", fails: true},
+		{pattern: "/", fails: true},
+		{pattern: "[a-", fails: true},
+	}
+	for _, test := range tests {
+		p, err := parsePattern(test.pattern)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parsePattern(%q) succeeded, expected an error", test.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePattern(%q) failed: %v", test.pattern, err)
+			continue
+		}
+		if len(p.segments) != len(test.segments) || p.anchored != test.anchored || p.dirOnly != test.dirOnly {
+			t.Errorf("parsePattern(%q) = %+v, expected segments %q, anchored %v, dirOnly %v",
+				test.pattern, *p, test.segments, test.anchored, test.dirOnly)
+			continue
+		}
+		for i := range p.segments {
+			if p.segments[i] != test.segments[i] {
+				t.Errorf("parsePattern(%q) segments = %q, expected %q", test.pattern, p.segments, test.segments)
+				break
+			}
+		}
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		match   bool
+	}{
+		{"*.tmp", "a.tmp", false, true},
+		{"*.tmp", "x/y/a.tmp", false, true},
+		{"*.tmp", "a.tmp/b", false, false},
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"cache/", "x/cache", true, true},
+		{"/build", "build", false, true},
+		{"/build", "x/build", false, false},
+		{"docs/*.md", "docs/a.md", false, true},
+		{"docs/*.md", "docs/x/a.md", false, false},
+		{"docs/*.md", "x/docs/a.md", false, false},
+		{"**/*.md", "a.md", false, true},
+		{"**/*.md", "x/y/a.md", false, true},
+		{"docs/**", "docs/x/y", false, true},
+		{"docs/**/a.md", "docs/a.md", false, true},
+		{"docs/**/a.md", "docs/x/y/a.md", false, true},
+		{"docs/**/a.md", "docs/x/y/b.md", false, false},
+		{"a/**/b/**/c", "a/x/b/y/z/c", false, true},
+		{"a/**/b/**/c", "a/x/y/c", false, false},
+	}
+	for _, test := range tests {
+		p, err := parsePattern(test.pattern)
+		if err != nil {
+			t.Fatalf("parsePattern(%q) failed: %v", test.pattern, err)
+		}
+		if match := p.Match(test.rel, test.isDir); match != test.match {
+			t.Errorf("%q matching %q (dir %v) = %v, expected %v", test.pattern, test.rel, test.isDir, match, test.match)
+		}
+	}
+}
+
+func TestMatchesPath(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		match    bool
+	}{
+		{[]string{"*.jpg"}, "photos/a.jpg", true},
+		{[]string{"*.jpg"}, "photos/a.png", false},
+		{[]string{"photos/"}, "photos/2020/a.png", true},
+		{[]string{"photos/"}, "photos", false},
+		{[]string{"/photos"}, "photos/a.png", true},
+		{[]string{"/photos"}, "x/photos/a.png", false},
+		{[]string{"*.jpg", "docs/**/*.md"}, "docs/x/a.md", true},
+		{[]string{"*.jpg", "docs/**/*.md"}, "a.md", false},
+	}
+	for _, test := range tests {
+		var patterns []*Pattern
+		for _, pattern := range test.patterns {
+			p, err := parsePattern(pattern)
+			if err != nil {
+				t.Fatalf("parsePattern(%q) failed: %v", pattern, err)
+			}
+			patterns = append(patterns, p)
+		}
+		if match := matchesPath(patterns, test.rel); match != test.match {
+			t.Errorf("%q matching %q = %v, expected %v", test.patterns, test.rel, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+)
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+type linkedCopy struct {
+	key  inodeKey
+	path string
+}
+
+// linkGroup is a set of source paths that share an inode
+type linkGroup struct {
+	source  string             // The first source path that was seen
+	targets map[int]linkedCopy // Entry index to its copy of the first path
+}
+
+// targetInode is an inode in one of the targets
+type targetInode struct {
+	idx int // Index in Config.entries
+	key inodeKey
+}
+
+// linkSource is what the first path of a target inode is a copy of
+type linkSource struct {
+	key    inodeKey
+	source string
+	target string
+}
+
+type linkHash struct {
+	once  sync.Once
+	hash  []byte
+	speed float64
+	err   error
+}
+
+// HardlinkTracker verifies that the hardlinks of the source are preserved in the targets
+type HardlinkTracker struct {
+	lock    sync.Mutex
+	enabled bool
+	groups  map[inodeKey]*linkGroup
+	sources map[targetInode]linkSource
+	hashes  map[FileID]*linkHash
+}
+
+func (ht *HardlinkTracker) Enable() {
+	ht.lock.Lock()
+	ht.enabled = true
+	ht.groups = map[inodeKey]*linkGroup{}
+	ht.sources = map[targetInode]linkSource{}
+	ht.hashes = map[FileID]*linkHash{}
+	ht.lock.Unlock()
+}
+
+// Checks that the targets are linked together the same way as the source,
+// neither splitting the source's hardlinks apart nor linking together separate source files.
+// Returns the number of such differences.
+func (ht *HardlinkTracker) Check(out *Output, replicas []Replica) (deltaMismatched int) {
+	src := &replicas[0]
+	srcID, ok := fileIdentity(src.path, src.info)
+	if !ok {
+		return
+	}
+
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	srcKey := inodeKey{dev: srcID.dev, ino: srcID.ino}
+	var group *linkGroup
+	if hardlinkCount(src.info) > 1 {
+		if group, ok = ht.groups[srcKey]; !ok {
+			group = &linkGroup{source: src.path, targets: map[int]linkedCopy{}}
+			ht.groups[srcKey] = group
+		}
+	}
+	for j := 1; j < len(replicas); j++ {
+		dst := &replicas[j]
+		dstID, ok := fileIdentity(dst.path, dst.info)
+		if !ok {
+			continue
+		}
+		dstKey := inodeKey{dev: dstID.dev, ino: dstID.ino}
+		if group != nil {
+			if first, ok := group.targets[dst.idx]; !ok {
+				group.targets[dst.idx] = linkedCopy{key: dstKey, path: dst.path}
+			} else if first.key != dstKey {
+				deltaMismatched++
+				out.Mismatch(newMetaEvent("BROKEN HARDLINK", src, dst, group.source, first.path))
+			}
+		}
+		if hardlinkCount(dst.info) > 1 {
+			inode := targetInode{idx: dst.idx, key: dstKey}
+			if first, ok := ht.sources[inode]; !ok {
+				ht.sources[inode] = linkSource{key: srcKey, source: src.path, target: dst.path}
+			} else if first.key != srcKey {
+				deltaMismatched++
+				out.Mismatch(newMetaEvent("UNEXPECTED HARDLINK", src, dst, first.source, first.target))
+			}
+		}
+	}
+	return
+}
+
+// Hashes the file only once for all of its hardlinks
+func (ht *HardlinkTracker) Hash(id FileID, hash func() ([]byte, float64, error)) ([]byte, float64, error) {
+	ht.lock.Lock()
+	if !ht.enabled {
+		ht.lock.Unlock()
+		return hash()
+	}
+	lh, ok := ht.hashes[id]
+	if !ok {
+		lh = &linkHash{}
+		ht.hashes[id] = lh
+	}
+	ht.lock.Unlock()
+
+	lh.once.Do(func() {
+		lh.hash, lh.speed, lh.err = hash()
+	})
+	return lh.hash, lh.speed, lh.err
+}
+
+var hardlinks = HardlinkTracker{}
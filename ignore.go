@@ -0,0 +1,116 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Directories can contain this file with gitignore-like rules for what to skip in them
+const ignoreFileName = ".braheignore"
+
+type ignoreRule struct {
+	pattern *Pattern
+	negate  bool // Brings back what an earlier rule ignored
+}
+
+// IgnoreFiles reads the .braheignore file of each directory once
+type IgnoreFiles struct {
+	lock  sync.Mutex
+	rules map[string][]ignoreRule // Directory to its rules
+}
+
+func (ifs *IgnoreFiles) rulesOf(dir string) []ignoreRule {
+	ifs.lock.Lock()
+	defer ifs.lock.Unlock()
+	if rules, ok := ifs.rules[dir]; ok {
+		return rules
+	}
+	if ifs.rules == nil {
+		ifs.rules = map[string][]ignoreRule{}
+	}
+	name := filepath.Join(dir, ignoreFileName)
+	rules, err := readIgnoreFile(name)
+	if err != nil {
+		reportError(name, err)
+	}
+	ifs.rules[dir] = rules
+	return rules
+}
+
+func readIgnoreFile(name string) ([]ignoreRule, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to open ignore file: %v", err)
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if rule.pattern, err = parsePattern(line); err != nil {
+			return nil, fmt.Errorf("Failed to parse line %d of the ignore file: %v", lineNr, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read ignore file: %v", err)
+	}
+	return rules, nil
+}
+
+// Returns whether the ignore files in the directories from root down to the entry ignore it.
+// Deeper and later rules take precedence, like with gitignore.
+func (ifs *IgnoreFiles) Ignored(root, fullName string, isDir bool) bool {
+	rel, err := filepath.Rel(root, fullName)
+	if err != nil {
+		return false
+	}
+	names := strings.Split(filepath.ToSlash(rel), "/")
+	ignored := false
+	dir := root
+	for k := range names {
+		if rules := ifs.rulesOf(dir); len(rules) > 0 {
+			sub := strings.Join(names[k:], "/")
+			for _, rule := range rules {
+				if rule.pattern.Match(sub, isDir) {
+					ignored = !rule.negate
+				}
+			}
+		}
+		dir = filepath.Join(dir, names[k])
+	}
+	return ignored
+}
+
+var braheIgnore = IgnoreFiles{}
@@ -0,0 +1,78 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	root, err := ioutil.TempDir("", "brahe-ignore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ignoreFiles := map[string]string{
+		"":        "# Comment\n*.tmp\n!keep.tmp\n/top\ncache/\n**/gen/*.go\n\\#hash\n",
+		"sub":     "!again.tmp\nlocal\n",
+		"sub/top": "!*\n",
+	}
+	for dir, rules := range ignoreFiles {
+		dir = filepath.Join(root, filepath.FromSlash(dir))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte(rules), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.txt", false, false},
+		{"a.tmp", false, true},
+		{"x/y/a.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"x/keep.tmp", false, false},
+		{"top", false, true},
+		{"x/top", false, false},
+		{"cache", true, true},
+		{"x/cache", true, true},
+		{"cache", false, false},
+		{"gen/a.go", false, true},
+		{"x/y/gen/a.go", false, true},
+		{"x/gen/y/a.go", false, false},
+		{"#hash", false, true},
+		{"sub/again.tmp", false, false},
+		{"sub/other.tmp", false, true},
+		{"sub/local", false, true},
+		{"local", false, false},
+		{"sub/top/a.tmp", false, false},
+	}
+	ifs := IgnoreFiles{}
+	for _, test := range tests {
+		fullName := filepath.Join(root, filepath.FromSlash(test.rel))
+		if ignored := ifs.Ignored(root, fullName, test.isDir); ignored != test.ignored {
+			t.Errorf("Ignored(%q, dir %v) = %v, expected %v", test.rel, test.isDir, ignored, test.ignored)
+		}
+	}
+}
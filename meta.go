@@ -0,0 +1,128 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	MetaMode    = "mode"
+	MetaOwner   = "owner"
+	MetaMtime   = "mtime"
+	MetaXattr   = "xattr"
+	MetaACL     = "acl"
+	MetaSELinux = "selinux"
+)
+
+var metaAttributes = []string{MetaACL, MetaMode, MetaMtime, MetaOwner, MetaSELinux, MetaXattr}
+
+// Returns the metadata event type for the provided extended attribute
+func xattrEventType(name string) (string, string) {
+	switch {
+	case strings.HasPrefix(name, "system.posix_acl_"):
+		return MetaACL, "ACL DIFFERS"
+	case name == "security.selinux":
+		return MetaSELinux, "SELINUX DIFFERS"
+	}
+	return MetaXattr, "XATTR DIFFERS"
+}
+
+func newMetaEvent(eventType string, src, dst *Replica, srcValue, dstValue string) *Event {
+	ev := newEvent(eventType, src, dst)
+	ev.SourceValue = srcValue
+	ev.TargetValue = dstValue
+	return ev
+}
+
+// Compares the selected metadata of the two entries.
+// Returns the number of differences.
+func compareMeta(cfg *Config, out *Output, src, dst *Replica) (deltaMismatched int) {
+	mismatch := func(ev *Event) {
+		deltaMismatched++
+		out.Mismatch(ev)
+	}
+
+	if cfg.meta[MetaMode] && src.info.Mode() != dst.info.Mode() {
+		mismatch(newMetaEvent("MODE DIFFERS", src, dst, src.info.Mode().String(), dst.info.Mode().String()))
+	}
+	if cfg.meta[MetaOwner] {
+		srcUID, srcGID, srcOK := fileOwner(src.info)
+		dstUID, dstGID, dstOK := fileOwner(dst.info)
+		if srcOK && dstOK && (srcUID != dstUID || srcGID != dstGID) {
+			mismatch(newMetaEvent("OWNER DIFFERS", src, dst, fmt.Sprintf("%d:%d", srcUID, srcGID), fmt.Sprintf("%d:%d", dstUID, dstGID)))
+		}
+	}
+	if cfg.meta[MetaMtime] && !mtimeWithin(src.info.ModTime(), dst.info.ModTime(), cfg.mtimeWindow) {
+		mismatch(newMetaEvent("MTIME DIFFERS", src, dst, src.info.ModTime().Format(time.RFC3339Nano), dst.info.ModTime().Format(time.RFC3339Nano)))
+	}
+
+	// Extended attributes of symlinks would be read from the link targets
+	if !cfg.meta[MetaXattr] && !cfg.meta[MetaACL] && !cfg.meta[MetaSELinux] || src.info.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+	srcAttrs, err := readXattrs(src.path)
+	if err != nil {
+		out.Error(src.path, fmt.Errorf("Failed to read extended attributes: %v", err))
+		return
+	}
+	dstAttrs, err := readXattrs(dst.path)
+	if err != nil {
+		out.Error(dst.path, fmt.Errorf("Failed to read extended attributes: %v", err))
+		return
+	}
+	names := make([]string, 0, len(srcAttrs)+len(dstAttrs))
+	for name := range srcAttrs {
+		names = append(names, name)
+	}
+	for name := range dstAttrs {
+		if _, ok := srcAttrs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attribute, eventType := xattrEventType(name)
+		srcValue, srcOK := srcAttrs[name]
+		dstValue, dstOK := dstAttrs[name]
+		if !cfg.meta[attribute] || srcOK == dstOK && bytes.Equal(srcValue, dstValue) {
+			continue
+		}
+		ev := newMetaEvent(eventType, src, dst, formatXattr(srcValue, srcOK), formatXattr(dstValue, dstOK))
+		ev.Attribute = name
+		mismatch(ev)
+	}
+	return
+}
+
+func mtimeWithin(a, b time.Time, window time.Duration) bool {
+	diff := a.Sub(b)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= window
+}
+
+func formatXattr(value []byte, ok bool) string {
+	if !ok {
+		return "(none)"
+	}
+	return fmt.Sprintf("%q", value)
+}
@@ -15,8 +15,11 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"math"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -73,8 +76,11 @@ type Stats struct {
 	matched     int
 	mismatched  int
 	missing     int
+	extra       int
 	ignored     int
 	copied      int
+	repaired    int
+	errors      int
 }
 
 func (s *Stats) Clone() *Stats {
@@ -84,15 +90,172 @@ func (s *Stats) Clone() *Stats {
 		matched:     s.matched,
 		mismatched:  s.mismatched,
 		missing:     s.missing,
+		extra:       s.extra,
 		ignored:     s.ignored,
 		copied:      s.copied,
+		repaired:    s.repaired,
+		errors:      s.errors,
 	}
 }
 
+type PathError struct {
+	path string
+	err  error
+}
+
+type ErrorLog struct {
+	lock     sync.Mutex
+	failFast bool
+	stopped  bool // Set by the first error with -fail-fast
+	entries  []PathError
+}
+
+// Notes that an error just happened, which with -fail-fast means that no more work should be started
+func (el *ErrorLog) Occurred() {
+	if el.failFast {
+		el.lock.Lock()
+		el.stopped = true
+		el.lock.Unlock()
+	}
+}
+
+// Returns true if an error has stopped the work because of -fail-fast
+func (el *ErrorLog) Stopped() bool {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	return el.stopped
+}
+
+func (el *ErrorLog) Add(path string, err error) {
+	el.lock.Lock()
+	el.entries = append(el.entries, PathError{path: path, err: err})
+	el.lock.Unlock()
+}
+
+func (el *ErrorLog) Entries() []PathError {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	return append([]PathError(nil), el.entries...)
+}
+
+// Event is a single result that gets written to the report.
+// The source fields describe the copy that is considered correct, which is usually in [source].
+type Event struct {
+	Type        string    `json:"type"`
+	Source      string    `json:"source,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	TargetIndex *int      `json:"target_index,omitempty"`
+	SourceHash  string    `json:"source_hash,omitempty"`
+	TargetHash  string    `json:"target_hash,omitempty"`
+	SourceSize  *int64    `json:"source_size,omitempty"`
+	TargetSize  *int64    `json:"target_size,omitempty"`
+	SourceValue string    `json:"source_value,omitempty"`
+	TargetValue string    `json:"target_value,omitempty"`
+	Attribute   string    `json:"attribute,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	Size        *int64    `json:"size,omitempty"`
+	Paths       []string  `json:"paths,omitempty"`
+	Wasted      *int64    `json:"wasted,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+func newEvent(eventType string, src, dst *Replica) *Event {
+	ev := &Event{Type: eventType, Time: time.Now()}
+	fileSize := func(replica *Replica) *int64 {
+		if replica.info == nil || replica.info.IsDir() {
+			return nil
+		}
+		size := replica.info.Size()
+		return &size
+	}
+	if src != nil {
+		ev.Source = src.path
+		ev.SourceSize = fileSize(src)
+	}
+	if dst != nil {
+		idx := dst.idx
+		ev.Target = dst.path
+		ev.TargetIndex = &idx
+		ev.TargetSize = fileSize(dst)
+	}
+	return ev
+}
+
+func (ev *Event) String() string {
+	switch {
+	case ev.Type == "BROKEN HARDLINK":
+		return fmt.Sprintf("BROKEN HARDLINK %v (not linked to %v)", ev.Target, ev.TargetValue)
+	case ev.Type == "UNEXPECTED HARDLINK":
+		return fmt.Sprintf("UNEXPECTED HARDLINK %v (linked to %v)", ev.Target, ev.TargetValue)
+	case ev.Type == "ERROR":
+		return fmt.Sprintf("ERROR %v - %v", ev.Path, ev.Error)
+	case ev.Type == "REPAIRED":
+		return fmt.Sprintf("REPAIRED %v from %v", ev.Target, ev.Source)
+	case ev.Type == "DUPLICATES":
+		return fmt.Sprintf("DUPLICATES %v - %v each, %v wasted\n  %v", ev.Hash, formatSize(*ev.Size), formatSize(*ev.Wasted), strings.Join(ev.Paths, "\n  "))
+	case ev.Type == "DUPLICATE" || ev.Type == "DELETED" || ev.Type == "QUARANTINED" || ev.Type == "HARDLINKED" || ev.Type == "REFLINKED":
+		return fmt.Sprintf("%v %v (duplicate of %v)", ev.Type, ev.Target, ev.Source)
+	case ev.Target == "":
+		return fmt.Sprintf("%v %v", ev.Type, ev.Source)
+	}
+	return fmt.Sprintf("%v %v", ev.Type, ev.Target)
+}
+
+// Report writes events into a file as newline delimited JSON
+type Report struct {
+	lock sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	enc  *json.Encoder
+	err  error
+}
+
+func (r *Report) Open(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.file = f
+	r.buf = bufio.NewWriter(f)
+	r.enc = json.NewEncoder(r.buf)
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *Report) Write(ev *Event) {
+	r.lock.Lock()
+	if r.enc != nil && r.err == nil {
+		r.err = r.enc.Encode(ev)
+	}
+	r.lock.Unlock()
+}
+
+// Returns the first error that happened while writing the report
+func (r *Report) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	if err := r.buf.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if err := r.file.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	r.file, r.buf, r.enc = nil, nil, nil
+	return r.err
+}
+
 var (
 	displayInfo = DisplayInfo{}
 	shutdown    = Shutdown{}
 	stats       = Stats{}
+	errorLog    = ErrorLog{}
+	report      = Report{}
 )
 
 func getSpaces(count int) string {
@@ -102,6 +265,19 @@ func getSpaces(count int) string {
 	return strings.Repeat(" ", count)
 }
 
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
 const maxLineWidth = 120 // TODO: Make this dynamic
 
 func ensureLineWidths(data string) string {
@@ -132,8 +308,26 @@ func writeToConsole(format string, a ...interface{}) {
 	displayInfo.lock.RUnlock()
 }
 
-func reportMismatch(format string, a ...interface{}) {
-	writeToConsole(format, a...)
+func reportMismatch(ev *Event) {
+	writeToConsole("%v", ev)
+	report.Write(ev)
+}
+
+// Matches only go into the report, as the console would be flooded otherwise
+func reportMatch(ev *Event) {
+	report.Write(ev)
+}
+
+// Reports a failure to deal with path. Unless we should fail fast, the work continues.
+func reportError(path string, err error) {
+	errorLog.Occurred()
+	ev := &Event{Type: "ERROR", Path: path, Error: err.Error(), Time: time.Now()}
+	writeToConsole("%v", ev)
+	report.Write(ev)
+	errorLog.Add(path, err)
+	stats.lock.Lock()
+	stats.errors++
+	stats.lock.Unlock()
 }
 
 func setDisplayInfo(line string) {
@@ -167,8 +361,14 @@ func statsGalore() {
 		if shutdown.start {
 			shutdown.lock.RUnlock()
 			stats.lock.Lock()
-			writeToConsole("Completed in %v with %d matches, %d mismatches, %d missing, %d ignored, %d copied.", totalDurStr(), stats.matched, stats.mismatched, stats.missing, stats.ignored, stats.copied)
+			writeToConsole("Completed in %v with %d matches, %d mismatches, %d missing, %d extra, %d ignored, %d copied, %d repaired, %d errors.", totalDurStr(), stats.matched, stats.mismatched, stats.missing, stats.extra, stats.ignored, stats.copied, stats.repaired, stats.errors)
 			stats.lock.Unlock()
+			if entries := errorLog.Entries(); len(entries) > 0 {
+				writeToConsole("Failed to deal with %d paths:", len(entries))
+				for _, entry := range entries {
+					writeToConsole("%v - %v", entry.path, entry.err)
+				}
+			}
 			shutdown.wg.Done()
 			return
 		}
@@ -180,7 +380,7 @@ func statsGalore() {
 		sc := stats.Clone()
 		stats.lock.Unlock()
 
-		line := fmt.Sprintf("[%v] [%.2f%% %d√ %dD %dM %dI %dC] ", totalDurStr(), sc.progress, sc.matched, sc.mismatched, sc.missing, sc.ignored, sc.copied)
+		line := fmt.Sprintf("[%v] [%.2f%% %d√ %dD %dM %dE %dI %dC %dR %d!] ", totalDurStr(), sc.progress, sc.matched, sc.mismatched, sc.missing, sc.extra, sc.ignored, sc.copied, sc.repaired, sc.errors)
 		path := sc.currentPath
 		maxPathLen := maxLineWidth - utf8.RuneCountInString(line) - 1
 		if pathLen := utf8.RuneCountInString(path); pathLen > maxPathLen {
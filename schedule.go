@@ -0,0 +1,107 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// IOScheduler limits how many files get read from each device at the same time.
+// This keeps spinning disks reading sequentially, while different disks can still be read in parallel.
+type IOScheduler struct {
+	lock         sync.Mutex
+	defaultLimit int            // 0 means no limit
+	limits       map[string]int // Per device overrides of defaultLimit
+	slots        map[string]chan struct{}
+}
+
+func (ios *IOScheduler) Configure(defaultLimit int, limits map[string]int) {
+	ios.lock.Lock()
+	ios.defaultLimit = defaultLimit
+	ios.limits = limits
+	ios.slots = map[string]chan struct{}{}
+	ios.lock.Unlock()
+}
+
+// Waits until the device of the file can be read from. The returned function must be called when done reading.
+func (ios *IOScheduler) Acquire(path string, info os.FileInfo) func() {
+	device, err := deviceOf(path, info)
+	if err != nil {
+		return func() {} // Let the read itself deal with any problems
+	}
+
+	ios.lock.Lock()
+	slot, ok := ios.slots[device]
+	if !ok {
+		limit, ok := ios.limits[device]
+		if !ok {
+			limit = ios.defaultLimit
+		}
+		if limit > 0 {
+			slot = make(chan struct{}, limit)
+		}
+		ios.slots[device] = slot
+	}
+	ios.lock.Unlock()
+
+	if slot == nil {
+		return func() {}
+	}
+	slot <- struct{}{}
+	return func() { <-slot }
+}
+
+var ioScheduler = IOScheduler{}
+
+// Hashes the file, unless the hash is already cached or its hardlink is already being hashed.
+// Returns hash, MB/s
+func hashReplica(replica *Replica) ([]byte, float64, error) {
+	f, err := os.Open(replica.path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	// The listed info might be stale or describe a symlink, so identify what was actually opened
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to stat file: %v", err)
+	}
+	id, identified := fileIdentity(replica.path, info)
+	if identified {
+		if hash, ok := hashCache.Get(id); ok {
+			return hash, 0, nil
+		}
+		if hardlinkCount(info) > 1 {
+			return hardlinks.Hash(id, func() ([]byte, float64, error) {
+				return readHash(f, replica.path, info, id, identified)
+			})
+		}
+	}
+	return readHash(f, replica.path, info, id, identified)
+}
+
+// Hashes the file once its device is free to be read from, and caches the hash if the file was identified
+func readHash(f *os.File, path string, info os.FileInfo, id FileID, identified bool) ([]byte, float64, error) {
+	release := ioScheduler.Acquire(path, info)
+	defer release()
+	hash, speed, err := hashOpenFile(f)
+	if err == nil && identified {
+		hashCache.Put(id, hash)
+	}
+	return hash, speed, err
+}
@@ -0,0 +1,50 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Returns the start and end of the next data region at or after offset, with the file positioned at its start.
+// Everything in between is a hole that reads as zeros. If the file system can't tell, it's all data.
+func nextDataRegion(f *os.File, offset, size int64) (int64, int64, error) {
+	data, err := f.Seek(offset, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return size, size, nil // Only a hole remains
+	} else if errors.Is(err, syscall.EINVAL) {
+		_, err = f.Seek(offset, io.SeekStart)
+		return offset, size, err
+	} else if err != nil {
+		return 0, 0, err
+	}
+	hole, err := f.Seek(data, seekHole)
+	if err != nil {
+		return 0, 0, err
+	}
+	if hole > size {
+		hole = size // The file grew, which the final read will take care of
+	}
+	if _, err = f.Seek(data, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	return data, hole, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+)
+
+// WorkPool runs tasks on a fixed number of goroutines, which includes the ones handing out the tasks.
+// Tasks can hand out further tasks, as handing out never blocks.
+type WorkPool struct {
+	tasks   chan func()
+	wg      sync.WaitGroup // The workers
+	pending sync.WaitGroup // The tasks that were handed to the workers
+}
+
+func (wp *WorkPool) Start(jobs int) {
+	wp.tasks = make(chan func())
+	// Whoever runs a task when all the workers are busy is the last job
+	wp.wg.Add(jobs - 1)
+	for i := 0; i < jobs-1; i++ {
+		go func() {
+			for task := range wp.tasks {
+				task()
+				wp.pending.Done()
+			}
+			wp.wg.Done()
+		}()
+	}
+}
+
+// Hands the task to a free worker, or runs it right away if they're all busy
+func (wp *WorkPool) Run(task func()) {
+	wp.pending.Add(1)
+	select {
+	case wp.tasks <- task:
+	default:
+		wp.pending.Done()
+		task()
+	}
+}
+
+// Waits for all the tasks to finish, after which no more tasks can be run
+func (wp *WorkPool) Stop() {
+	wp.pending.Wait()
+	close(wp.tasks)
+	wp.wg.Wait()
+}
+
+// Calls fn for every index from 0 to n-1 using the pool and waits for all of them to finish
+func (wp *WorkPool) ForEach(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		wp.Run(func() {
+			fn(i)
+			wg.Done()
+		})
+	}
+	wg.Wait()
+}
+
+type outputItem struct {
+	ev      *Event
+	console bool
+	path    string
+	err     error
+	nested  *Output
+}
+
+// Output holds on to the results of a piece of work until it's their turn to be written out.
+// This keeps the output in a deterministic order even when the work is done concurrently.
+// Outputs can be nested, e.g. for the results of a subdirectory that is walked concurrently.
+type Output struct {
+	lock    sync.Mutex
+	items   []outputItem
+	done    bool
+	changed chan struct{} // Closed whenever an item is added or the output is done
+}
+
+func newOutput() *Output {
+	return &Output{changed: make(chan struct{})}
+}
+
+func (o *Output) add(item outputItem) {
+	o.lock.Lock()
+	o.items = append(o.items, item)
+	close(o.changed)
+	o.changed = make(chan struct{})
+	o.lock.Unlock()
+}
+
+func (o *Output) Mismatch(ev *Event) {
+	o.add(outputItem{ev: ev, console: true})
+}
+
+func (o *Output) Match(ev *Event) {
+	o.add(outputItem{ev: ev})
+}
+
+// The error gets written out in order like the rest of the results,
+// but -fail-fast stops any further work right away.
+func (o *Output) Error(path string, err error) {
+	errorLog.Occurred()
+	o.add(outputItem{path: path, err: err})
+}
+
+// Returns a new output whose results get written out at this point, once the earlier ones are.
+// The new output also needs to be marked as done.
+func (o *Output) Nest() *Output {
+	nested := newOutput()
+	o.add(outputItem{nested: nested})
+	return nested
+}
+
+// Marks the work as finished, no more results can be added after this
+func (o *Output) Done() {
+	o.lock.Lock()
+	o.done = true
+	close(o.changed)
+	o.changed = make(chan struct{})
+	o.lock.Unlock()
+}
+
+// Writes out the results as they arrive, until the output is done
+func (o *Output) flush() {
+	for {
+		o.lock.Lock()
+		items, done, changed := o.items, o.done, o.changed
+		o.items = nil // Let the written out results be freed
+		o.lock.Unlock()
+
+		for _, item := range items {
+			if item.nested != nil {
+				item.nested.flush()
+			} else if item.err != nil {
+				reportError(item.path, item.err)
+			} else if item.console {
+				reportMismatch(item.ev)
+			} else {
+				reportMatch(item.ev)
+			}
+		}
+		if len(items) == 0 {
+			if done {
+				return
+			}
+			<-changed
+		}
+	}
+}
+
+// OutputQueue writes out the results in the order they were queued, as soon as they're done
+type OutputQueue struct {
+	root     *Output
+	finished chan struct{}
+}
+
+func (oq *OutputQueue) Start() {
+	oq.root = newOutput()
+	oq.finished = make(chan struct{})
+	go func() {
+		oq.root.flush()
+		close(oq.finished)
+	}()
+}
+
+// Queues up a new output and returns it
+func (oq *OutputQueue) Push() *Output {
+	return oq.root.Nest()
+}
+
+// Waits for all the queued results to be written out, after which nothing more can be queued
+func (oq *OutputQueue) Stop() {
+	oq.root.Done()
+	<-oq.finished
+}
+
+var (
+	workPool    = WorkPool{}
+	outputQueue = OutputQueue{}
+)
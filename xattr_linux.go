@@ -0,0 +1,85 @@
+// Copyright 2016-2020 Kaur Kuut
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+const xattrSupported = true
+
+// Returns all the extended attributes of the file, including ACLs and SELinux labels
+func readXattrs(path string) (map[string][]byte, error) {
+	list, err := readXattrBuffer(func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(list, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := readXattrBuffer(func(dest []byte) (int, error) {
+			return syscall.Getxattr(path, string(name), dest)
+		})
+		if err == syscall.ENODATA {
+			continue // Removed while we were looking
+		} else if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+// Copies all the extended attributes of src onto dst, including ACLs and SELinux labels
+func copyXattrs(src, dst string) error {
+	attrs, err := readXattrs(src)
+	if err == syscall.ENOTSUP {
+		return nil // The filesystem has none to copy
+	} else if err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		if err := syscall.Setxattr(dst, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls read with a large enough buffer, retrying when the data grows in between
+func readXattrBuffer(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = read(buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}